@@ -1,13 +1,20 @@
 package cony
 
 import (
+	"errors"
+	"math"
 	"math/rand"
+	"sync"
 	"time"
 )
 
+// ErrReconnectLimit is reported when backoff policy gives up reconnecting,
+// see MaxAttempts() and MaxElapsed(). The Client is closed.
+var ErrReconnectLimit = errors.New("Reconnect limit reached")
+
 // DefaultBackoff See: http://blog.gopheracademy.com/advent-2014/backoff/
 var DefaultBackoff Backoffer = BackoffPolicy{
-	[]int{0, 10, 100, 200, 500, 1000, 2000, 3000, 5000},
+	ms: []int{0, 10, 100, 200, 500, 1000, 2000, 3000, 5000},
 }
 
 // Backoffer is interface to hold Backoff strategy
@@ -15,9 +22,33 @@ type Backoffer interface {
 	Backoff(int) time.Duration
 }
 
+// BackoffLimiter is implemented by Backoffers which give up reconnecting.
+// GiveUp is called with the number of failed attempts in a row and time
+// since the first of them.
+type BackoffLimiter interface {
+	GiveUp(attempts int, elapsed time.Duration) bool
+}
+
 // BackoffPolicy is a default Backoffer implementation
 type BackoffPolicy struct {
-	ms []int
+	ms  []int
+	rnd *lockedRand // math/rand if nil
+}
+
+// NewBackoffPolicy creates BackoffPolicy from a table of waits in
+// milliseconds, the last one is used for all further attempts
+func NewBackoffPolicy(ms ...int) BackoffPolicy {
+	if len(ms) == 0 {
+		ms = []int{0}
+	}
+	return BackoffPolicy{ms: ms}
+}
+
+// WithSource returns a copy of the policy taking jitter from src, set it for
+// deterministic waits in tests
+func (b BackoffPolicy) WithSource(src rand.Source) BackoffPolicy {
+	b.rnd = newLockedRand(src)
+	return b
 }
 
 // Backoff implements Backoffer
@@ -26,13 +57,237 @@ func (b BackoffPolicy) Backoff(n int) time.Duration {
 		n = len(b.ms) - 1
 	}
 
-	return time.Duration(jitter(b.ms[n])) * time.Millisecond
+	return time.Duration(b.jitter(b.ms[n])) * time.Millisecond
 }
 
-func jitter(ms int) int {
+func (b BackoffPolicy) jitter(ms int) int {
 	if ms == 0 {
 		return 0
 	}
 
-	return ms/2 + rand.Intn(ms)
+	return ms/2 + b.rnd.intn(ms)
+}
+
+// lockedRand is rand.Rand safe for concurrent use, as Backoffers are shared
+// by reconnect and channel reopen loops. Nil lockedRand uses math/rand.
+type lockedRand struct {
+	r *rand.Rand
+	l sync.Mutex
+}
+
+func newLockedRand(src rand.Source) *lockedRand {
+	if src == nil {
+		return nil
+	}
+	return &lockedRand{r: rand.New(src)}
+}
+
+func (r *lockedRand) intn(n int) int {
+	if r == nil {
+		return rand.Intn(n)
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.r.Intn(n)
+}
+
+func (r *lockedRand) int63n(n int64) int64 {
+	if r == nil {
+		return rand.Int63n(n)
+	}
+
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.r.Int63n(n)
+}
+
+// forker is implemented by Backoffers keeping state between attempts
+type forker interface {
+	fork() Backoffer
+}
+
+// forkBackoff returns bo for a single reconnect or channel reopen loop.
+// Backoffers with state, like ExponentialBackoff with DecorrelatedJitter, are
+// copied, so loops don't skew each other's waits.
+func forkBackoff(bo Backoffer) Backoffer {
+	if f, ok := bo.(forker); ok {
+		return f.fork()
+	}
+	return bo
+}
+
+// Jitter randomizes waits of ExponentialBackoff, so clients don't reconnect
+// all at once. See:
+// https://aws.amazon.com/blogs/architecture/exponential-backoff-and-jitter/
+type Jitter int
+
+const (
+	// NoJitter waits exactly the exponential delay
+	NoJitter Jitter = iota
+	// FullJitter waits random time between 0 and the exponential delay
+	FullJitter
+	// EqualJitter waits half of the exponential delay plus random time up to
+	// the other half
+	EqualJitter
+	// DecorrelatedJitter waits random time between Initial and three times
+	// the previous wait
+	DecorrelatedJitter
+)
+
+const (
+	defaultBackoffInitial = 100 * time.Millisecond
+	defaultBackoffMax     = 5 * time.Second
+)
+
+// ExponentialBackoff is a Backoffer which doubles the wait (or multiplies it
+// by Multiplier) on every attempt, up to Max
+type ExponentialBackoff struct {
+	Initial    time.Duration // 100ms if zero
+	Max        time.Duration // 5s if zero
+	Multiplier float64       // 2 if zero
+	Jitter     Jitter
+	Source     rand.Source // math/rand if nil, set for deterministic waits in tests
+
+	prev time.Duration // previous wait, for DecorrelatedJitter
+	rnd  *lockedRand   // made of Source, shared with forks
+	l    sync.Mutex
+}
+
+// NewExponentialBackoff creates ExponentialBackoff waiting from initial up to
+// max
+func NewExponentialBackoff(initial, max time.Duration, jitter Jitter) *ExponentialBackoff {
+	return &ExponentialBackoff{
+		Initial: initial,
+		Max:     max,
+		Jitter:  jitter,
+	}
+}
+
+// Backoff implements Backoffer
+func (b *ExponentialBackoff) Backoff(n int) time.Duration {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if b.Jitter == DecorrelatedJitter {
+		return b.decorrelated(n)
+	}
+
+	mult := b.Multiplier
+	if mult == 0 {
+		mult = 2
+	}
+
+	initial, max := b.limits()
+	d := max
+	if exp := float64(initial) * math.Pow(mult, float64(n)); exp < float64(max) {
+		d = time.Duration(exp)
+	}
+
+	switch b.Jitter {
+	case FullJitter:
+		return b.random(0, d)
+	case EqualJitter:
+		return d/2 + b.random(0, d-d/2)
+	}
+	return d
+}
+
+func (b *ExponentialBackoff) decorrelated(n int) time.Duration {
+	initial, max := b.limits()
+	if n == 0 || b.prev < initial {
+		b.prev = initial
+	}
+
+	d := b.random(initial, b.prev*3)
+	if d > max {
+		d = max
+	}
+	b.prev = d
+
+	return d
+}
+
+// limits returns Initial and Max, defaulted if zero
+func (b *ExponentialBackoff) limits() (initial, max time.Duration) {
+	initial, max = b.Initial, b.Max
+	if initial <= 0 {
+		initial = defaultBackoffInitial
+	}
+	if max <= 0 {
+		max = defaultBackoffMax
+	}
+	return initial, max
+}
+
+// random returns random duration in [min, max)
+func (b *ExponentialBackoff) random(min, max time.Duration) time.Duration {
+	if max <= min {
+		return min
+	}
+
+	if b.rnd == nil {
+		b.rnd = newLockedRand(b.Source)
+	}
+	return min + time.Duration(b.rnd.int63n(int64(max-min)))
+}
+
+// fork implements forker, the copy has its own DecorrelatedJitter state
+func (b *ExponentialBackoff) fork() Backoffer {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	if b.rnd == nil {
+		b.rnd = newLockedRand(b.Source)
+	}
+
+	return &ExponentialBackoff{
+		Initial:    b.Initial,
+		Max:        b.Max,
+		Multiplier: b.Multiplier,
+		Jitter:     b.Jitter,
+		Source:     b.Source,
+		rnd:        b.rnd,
+	}
+}
+
+// limitedBackoff gives up after a number of attempts or time
+type limitedBackoff struct {
+	Backoffer
+	attempts int
+	elapsed  time.Duration
+}
+
+// GiveUp implements BackoffLimiter
+func (b limitedBackoff) GiveUp(attempts int, elapsed time.Duration) bool {
+	if b.attempts > 0 && attempts >= b.attempts {
+		return true
+	}
+
+	if b.elapsed > 0 && elapsed >= b.elapsed {
+		return true
+	}
+
+	if lim, ok := b.Backoffer.(BackoffLimiter); ok {
+		return lim.GiveUp(attempts, elapsed)
+	}
+	return false
+}
+
+// fork implements forker
+func (b limitedBackoff) fork() Backoffer {
+	b.Backoffer = forkBackoff(b.Backoffer)
+	return b
+}
+
+// MaxAttempts limits bo to n failed reconnect attempts in a row, then Client
+// reports ErrReconnectLimit and closes
+func MaxAttempts(bo Backoffer, n int) Backoffer {
+	return limitedBackoff{Backoffer: bo, attempts: n}
+}
+
+// MaxElapsed limits bo to reconnecting for d since the first failed attempt,
+// then Client reports ErrReconnectLimit and closes
+func MaxElapsed(bo Backoffer, d time.Duration) Backoffer {
+	return limitedBackoff{Backoffer: bo, elapsed: d}
 }
@@ -3,11 +3,12 @@ package cony
 import (
 	"math/rand"
 	"testing"
+	"time"
 )
 
 func TestBackoffPolicy_Backoff(t *testing.T) {
 	rand.Seed(0)
-	bp := BackoffPolicy{[]int{0, 100, 1000, 10000}}
+	bp := BackoffPolicy{ms: []int{0, 100, 1000, 10000}}
 
 	if bp.Backoff(0) != 0 {
 		t.Error("should return zero time duration")
@@ -34,3 +35,157 @@ func TestBackoffPolicy_Backoff(t *testing.T) {
 		}
 	}
 }
+
+func TestNewBackoffPolicy(t *testing.T) {
+	bp := NewBackoffPolicy(0, 10)
+
+	if bp.Backoff(0) != 0 {
+		t.Error("should use custom table")
+	}
+
+	if d := bp.Backoff(5); d < 5*time.Millisecond || d >= 15*time.Millisecond {
+		t.Error("should repeat the last wait, got", d)
+	}
+
+	if NewBackoffPolicy().Backoff(3) != 0 {
+		t.Error("empty table should not wait")
+	}
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	bo := NewExponentialBackoff(100*time.Millisecond, time.Second, NoJitter)
+
+	tab := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+
+	for n, d := range tab {
+		if got := bo.Backoff(n); got != d {
+			t.Errorf("try %d should wait %s, got %s", n, d, got)
+		}
+	}
+
+	if bo.Backoff(10000) != time.Second {
+		t.Error("should cap huge attempt numbers")
+	}
+
+	bo.Multiplier = 3
+	if bo.Backoff(2) != 900*time.Millisecond {
+		t.Error("should use multiplier")
+	}
+}
+
+func TestExponentialBackoff_jitter(t *testing.T) {
+	for _, jitter := range []Jitter{FullJitter, EqualJitter, DecorrelatedJitter} {
+		bo := NewExponentialBackoff(100*time.Millisecond, time.Second, jitter)
+		bo.Source = rand.NewSource(1)
+
+		var waits []time.Duration
+		for n := 0; n < 20; n++ {
+			d := bo.Backoff(n)
+			waits = append(waits, d)
+
+			min := time.Duration(0)
+			switch jitter {
+			case EqualJitter:
+				min = 50 * time.Millisecond
+			case DecorrelatedJitter:
+				min = 100 * time.Millisecond
+			}
+
+			if d < min || d > time.Second {
+				t.Errorf("jitter %d: try %d wait %s out of range", jitter, n, d)
+			}
+		}
+
+		bo.Source = rand.NewSource(1)
+		bo.rnd = nil
+		bo.prev = 0
+		for n, d := range waits {
+			if bo.Backoff(n) != d {
+				t.Errorf("jitter %d: should be deterministic with seeded source", jitter)
+				break
+			}
+		}
+	}
+}
+
+func TestExponentialBackoff_defaults(t *testing.T) {
+	bo := &ExponentialBackoff{}
+
+	if d := bo.Backoff(0); d != defaultBackoffInitial {
+		t.Error("should default Initial, got", d)
+	}
+
+	if d := bo.Backoff(100); d != defaultBackoffMax {
+		t.Error("should default Max, got", d)
+	}
+
+	bo.Jitter = DecorrelatedJitter
+	for n := 0; n < 10; n++ {
+		if d := bo.Backoff(n); d < defaultBackoffInitial || d > defaultBackoffMax {
+			t.Errorf("try %d wait %s out of range", n, d)
+		}
+	}
+}
+
+func TestExponentialBackoff_fork(t *testing.T) {
+	bo := NewExponentialBackoff(100*time.Millisecond, time.Hour, DecorrelatedJitter)
+	bo.Source = rand.NewSource(1)
+
+	link := forkBackoff(bo).(*ExponentialBackoff)
+	reopen := forkBackoff(MaxAttempts(bo, 10)).(limitedBackoff).Backoffer.(*ExponentialBackoff)
+
+	for n := 0; n < 10; n++ {
+		link.Backoff(n)
+	}
+
+	// previous wait of the other loop is not taken into account
+	if d := reopen.Backoff(1); d >= 300*time.Millisecond {
+		t.Error("forks should keep their own state, got", d)
+	}
+
+	if bo.prev != 0 {
+		t.Error("should not change state of the original")
+	}
+}
+
+func TestBackoffPolicy_WithSource(t *testing.T) {
+	bp := NewBackoffPolicy(0, 100, 1000)
+
+	var waits []time.Duration
+	b1 := bp.WithSource(rand.NewSource(1))
+	for n := 0; n < 5; n++ {
+		waits = append(waits, b1.Backoff(n))
+	}
+
+	b2 := bp.WithSource(rand.NewSource(1))
+	for n, d := range waits {
+		if b2.Backoff(n) != d {
+			t.Fatal("should be deterministic with seeded source")
+		}
+	}
+}
+
+func TestMaxAttempts(t *testing.T) {
+	bo := MaxAttempts(NewBackoffPolicy(10), 3)
+
+	if bo.Backoff(1) == 0 {
+		t.Error("should wait as wrapped policy")
+	}
+
+	lim := bo.(BackoffLimiter)
+	if lim.GiveUp(2, time.Hour) || !lim.GiveUp(3, 0) {
+		t.Error("should give up after 3 attempts")
+	}
+
+	lim = MaxElapsed(bo, time.Minute).(BackoffLimiter)
+	if !lim.GiveUp(1, time.Minute) || !lim.GiveUp(3, 0) || lim.GiveUp(1, time.Second) {
+		t.Error("should combine limits")
+	}
+}
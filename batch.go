@@ -0,0 +1,145 @@
+package cony
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// BatchLimits define when a batch is complete: whichever of the limits is
+// reached first. Zero values are not limiting, but at least one of Count and
+// Wait should be set.
+type BatchLimits struct {
+	Count int           // number of messages
+	Bytes int           // total size of message bodies
+	Wait  time.Duration // since the first message of the batch
+}
+
+// BatchHandler processes a batch of messages. The batch is acknowledged at
+// once if it returns nil, otherwise it's rejected and requeued.
+type BatchHandler func([]amqp.Delivery) error
+
+// BatchConsumer hands deliveries of a Consumer to handler in batches
+type BatchConsumer struct {
+	*Consumer
+	limits   BatchLimits
+	handling chan struct{} // closed once Handle returns, nil if never run
+	l        sync.Mutex
+}
+
+// NewBatchConsumer creates BatchConsumer of queue q. Prefetch is set to
+// limits.Count by default, as smaller one would never fill a batch.
+func NewBatchConsumer(q *Queue, limits BatchLimits, opts ...ConsumerOpt) *BatchConsumer {
+	if limits.Count > 0 {
+		opts = append([]ConsumerOpt{Qos(limits.Count)}, opts...)
+	}
+
+	bc := &BatchConsumer{
+		Consumer: NewConsumer(q, opts...),
+		limits:   limits,
+	}
+	bc.onCancel = bc.waitHandle
+	return bc
+}
+
+// waitHandle waits until running Handle flushes partial batch on cancel, so
+// it's acknowledged before the channel is closed
+func (bc *BatchConsumer) waitHandle() {
+	bc.l.Lock()
+	handling := bc.handling
+	bc.l.Unlock()
+
+	if handling != nil {
+		<-handling
+	}
+}
+
+// Handle processes deliveries with h in batches until ctx is done or
+// consumer is canceled. Partial batch is handled then, on cancel the channel
+// is closed only after it's acknowledged. Partial batch is also handled when
+// the channel it was received on is gone (e.g. on reconnect): delivery tags
+// are per channel, so batch never spans channels. Acking batch of a gone
+// channel fails with ErrStaleDelivery, messages are redelivered by the
+// server. Ack errors are reported to Errors().
+func (bc *BatchConsumer) Handle(ctx context.Context, h BatchHandler) error {
+	handling := make(chan struct{})
+	bc.l.Lock()
+	bc.handling = handling
+	bc.l.Unlock()
+	defer close(handling)
+
+	var (
+		batch []amqp.Delivery
+		size  int
+		wait  <-chan time.Time
+		gone  <-chan struct{}
+		timer *time.Timer
+	)
+
+	flush := func() {
+		if len(batch) > 0 {
+			bc.handle(batch, h)
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		batch, size, wait, gone, timer = nil, 0, nil, nil, nil
+	}
+	defer flush()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-wait:
+			flush()
+		case <-gone:
+			flush()
+		case d, ok := <-bc.Deliveries():
+			if !ok {
+				return nil
+			}
+
+			if g := channelGone(d); len(batch) > 0 && g != gone {
+				flush()
+			}
+
+			if len(batch) == 0 {
+				gone = channelGone(d)
+				if bc.limits.Wait > 0 {
+					timer = time.NewTimer(bc.limits.Wait)
+					wait = timer.C
+				}
+			}
+
+			batch = append(batch, d)
+			size += len(d.Body)
+
+			if bc.limits.Count > 0 && len(batch) >= bc.limits.Count ||
+				bc.limits.Bytes > 0 && size >= bc.limits.Bytes {
+				flush()
+			}
+		}
+	}
+}
+
+// handle runs h on the batch and acks or nacks all of its messages with the
+// last delivery tag
+func (bc *BatchConsumer) handle(batch []amqp.Delivery, h BatchHandler) {
+	last := batch[len(batch)-1]
+	ack := last.Acknowledger != nil && !bc.autoAck
+
+	if err := h(batch); err != nil {
+		bc.reportErr(err)
+		if ack {
+			bc.reportErr(last.Nack(true, true))
+		}
+		return
+	}
+
+	if ack {
+		bc.reportErr(last.Ack(true))
+	}
+}
@@ -0,0 +1,171 @@
+package cony
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// handleBatches runs Handle in background and returns received batches
+func handleBatches(bc *BatchConsumer, h BatchHandler) (chan []amqp.Delivery, chan error) {
+	batches := make(chan []amqp.Delivery, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- bc.Handle(context.Background(), func(batch []amqp.Delivery) error {
+			batches <- batch
+			if h != nil {
+				return h(batch)
+			}
+			return nil
+		})
+	}()
+
+	return batches, done
+}
+
+func TestBatchConsumer_count(t *testing.T) {
+	ack := &testAcknowledger{}
+	bc := NewBatchConsumer(&Queue{}, BatchLimits{Count: 2, Bytes: 10})
+
+	if bc.qos != 2 {
+		t.Error("should set prefetch to batch count, got", bc.qos)
+	}
+
+	batches, done := handleBatches(bc, nil)
+
+	for i := uint64(1); i <= 3; i++ {
+		bc.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: i, Body: []byte("1")}
+	}
+
+	if batch := <-batches; len(batch) != 2 {
+		t.Error("should batch by count, got", len(batch))
+	}
+
+	bc.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 4, Body: []byte("0123456789")}
+	if batch := <-batches; len(batch) != 2 {
+		t.Error("should batch by bytes, got", len(batch))
+	}
+
+	bc.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 5}
+	bc.Cancel()
+
+	if batch := <-batches; len(batch) != 1 {
+		t.Error("should flush partial batch on cancel, got", len(batch))
+	}
+
+	if err := <-done; err != nil {
+		t.Error("should return nil once canceled, got", err)
+	}
+
+	if len(ack.acked) != 3 || ack.acked[0] != 2 || ack.acked[1] != 4 || ack.acked[2] != 5 {
+		t.Error("should ack batch with the last tag, got", ack.acked)
+	}
+}
+
+func TestBatchConsumer_wait(t *testing.T) {
+	ack := &testAcknowledger{}
+	bc := NewBatchConsumer(&Queue{}, BatchLimits{Count: 100, Wait: 10 * time.Millisecond})
+	handleErr := errors.New("handle")
+
+	batches, done := handleBatches(bc, func([]amqp.Delivery) error {
+		return handleErr
+	})
+
+	bc.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+	bc.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 2}
+
+	select {
+	case batch := <-batches:
+		if len(batch) != 2 {
+			t.Error("should flush partial batch after wait, got", len(batch))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("should flush partial batch after wait")
+	}
+
+	if err := <-bc.Errors(); err != handleErr {
+		t.Error("should report handler error, got", err)
+	}
+
+	bc.Cancel()
+	<-done
+
+	if len(ack.nacked) != 1 || ack.nacked[0] != 2 {
+		t.Error("should nack failed batch, got", ack.nacked)
+	}
+}
+
+func TestBatchConsumer_reconnect(t *testing.T) {
+	var (
+		ack        = &testAcknowledger{}
+		deliveries = make(chan amqp.Delivery)
+		done       = make(chan bool)
+	)
+
+	bc := NewBatchConsumer(&Queue{}, BatchLimits{Count: 100})
+	ch1 := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+			return deliveries, nil
+		},
+	}
+
+	go func() {
+		bc.serve(&mqDeleterTest{}, ch1)
+		done <- true
+	}()
+
+	batches, handled := handleBatches(bc, nil)
+
+	deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+	close(deliveries) // connection is gone
+	<-done
+
+	if batch := <-batches; len(batch) != 1 {
+		t.Error("should flush partial batch once channel is gone, got", len(batch))
+	}
+
+	if err := <-bc.Errors(); err != ErrStaleDelivery {
+		t.Error("should report stale ack, got", err)
+	}
+
+	bc.Cancel()
+	<-handled
+}
+
+func TestBatchConsumer_cancel(t *testing.T) {
+	ack := &testAcknowledger{}
+	bc := NewBatchConsumer(&Queue{}, BatchLimits{Count: 100})
+
+	if bc.onCancel != nil {
+		// Handle is not running, nothing to wait for
+		bc.onCancel()
+	}
+
+	batches, done := handleBatches(bc, nil)
+
+	bc.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+	bc.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 2}
+	bc.Cancel()
+
+	// serve goroutine runs it before closing the channel
+	bc.onCancel()
+
+	if len(ack.acked) != 1 || ack.acked[0] != 2 {
+		t.Error("should ack partial batch before the channel is closed, got", ack.acked)
+	}
+
+	if batch := <-batches; len(batch) != 2 {
+		t.Error("should flush partial batch on cancel, got", len(batch))
+	}
+
+	if err := <-done; err != nil {
+		t.Error("should return nil once canceled, got", err)
+	}
+}
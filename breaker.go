@@ -0,0 +1,295 @@
+package cony
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned while circuit breaker is open, operation is not
+// attempted
+var ErrBreakerOpen = errors.New("Circuit breaker is open")
+
+// BreakerState is a state of CircuitBreaker
+type BreakerState int
+
+const (
+	// BreakerClosed lets operations through, counting failures
+	BreakerClosed BreakerState = iota
+	// BreakerOpen fails operations fast until open timeout passes
+	BreakerOpen
+	// BreakerHalfOpen lets a limited number of probes through, success
+	// closes the breaker, failure opens it again
+	BreakerHalfOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerClosed:
+		return "closed"
+	case BreakerOpen:
+		return "open"
+	case BreakerHalfOpen:
+		return "half-open"
+	}
+	return "unknown"
+}
+
+// BreakerEvent is a state transition of CircuitBreaker
+type BreakerEvent struct {
+	From BreakerState
+	To   BreakerState
+	At   time.Time
+}
+
+// BreakerStats are CircuitBreaker counters, for metrics
+type BreakerStats struct {
+	State               BreakerState
+	Successes           uint64
+	Failures            uint64
+	Rejected            uint64 // operations failed fast while open
+	Trips               uint64 // times breaker opened
+	ConsecutiveFailures int
+}
+
+// BreakerOpt is a CircuitBreaker's functional option type
+type BreakerOpt func(*CircuitBreaker)
+
+// CircuitBreaker stops attempting operations after a number of consecutive
+// failures, and probes again once open timeout passes. It's safe for
+// concurrent use, the same breaker could guard connection attempts and
+// publishers, see ConnectBreaker() and PublishBreaker().
+type CircuitBreaker struct {
+	threshold int
+	timeout   time.Duration
+	probes    int
+	events    chan BreakerEvent
+	now       func() time.Time
+
+	state    BreakerState
+	openedAt time.Time
+	inFlight int // probes let through while half-open
+	stats    BreakerStats
+	l        sync.Mutex
+}
+
+// halfOpenRetry is how often rejected callers check a half-open breaker again
+const halfOpenRetry = 100 * time.Millisecond
+
+// NewCircuitBreaker creates CircuitBreaker which opens after 5 consecutive
+// failures for 30 seconds, then lets a single probe through
+func NewCircuitBreaker(opts ...BreakerOpt) *CircuitBreaker {
+	cb := &CircuitBreaker{
+		threshold: 5,
+		timeout:   30 * time.Second,
+		probes:    1,
+		events:    make(chan BreakerEvent, 10),
+		now:       time.Now,
+	}
+	for _, o := range opts {
+		o(cb)
+	}
+	return cb
+}
+
+// FailureThreshold is a CircuitBreaker's functional option, number of
+// consecutive failures which open the breaker
+func FailureThreshold(n int) BreakerOpt {
+	return func(cb *CircuitBreaker) {
+		cb.threshold = n
+	}
+}
+
+// OpenTimeout is a CircuitBreaker's functional option, how long breaker stays
+// open before letting probes through
+func OpenTimeout(d time.Duration) BreakerOpt {
+	return func(cb *CircuitBreaker) {
+		cb.timeout = d
+	}
+}
+
+// HalfOpenProbes is a CircuitBreaker's functional option, number of
+// operations let through while half-open
+func HalfOpenProbes(n int) BreakerOpt {
+	return func(cb *CircuitBreaker) {
+		cb.probes = n
+	}
+}
+
+// BreakerEvents is a CircuitBreaker's functional option, used to initialize
+// state transitions channel in client code, maintaining control over buffer
+// size. Default buffer size is 10. Events will be dropped in case if
+// receiver can't keep up.
+func BreakerEvents(events chan BreakerEvent) BreakerOpt {
+	return func(cb *CircuitBreaker) {
+		cb.events = events
+	}
+}
+
+// Events returns state transitions
+func (cb *CircuitBreaker) Events() <-chan BreakerEvent {
+	return cb.events
+}
+
+// State returns current state
+func (cb *CircuitBreaker) State() BreakerState {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+	cb.halfOpen()
+	return cb.state
+}
+
+// Stats returns counters
+func (cb *CircuitBreaker) Stats() BreakerStats {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+	cb.halfOpen()
+	stats := cb.stats
+	stats.State = cb.state
+	return stats
+}
+
+// Allow returns ErrBreakerOpen if operation should not be attempted. Every
+// allowed operation should be reported with Success() or Failure().
+func (cb *CircuitBreaker) Allow() error {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+
+	cb.halfOpen()
+
+	switch {
+	case cb.state == BreakerOpen,
+		cb.state == BreakerHalfOpen && cb.inFlight >= cb.probes:
+		cb.stats.Rejected++
+		return ErrBreakerOpen
+	case cb.state == BreakerHalfOpen:
+		cb.inFlight++
+	}
+
+	return nil
+}
+
+// Success reports successful operation
+func (cb *CircuitBreaker) Success() {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+
+	cb.stats.Successes++
+	cb.stats.ConsecutiveFailures = 0
+
+	if cb.state == BreakerHalfOpen {
+		cb.setState(BreakerClosed)
+	}
+}
+
+// Failure reports failed operation
+func (cb *CircuitBreaker) Failure() {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+
+	cb.stats.Failures++
+	cb.stats.ConsecutiveFailures++
+
+	if cb.state == BreakerHalfOpen ||
+		cb.state == BreakerClosed && cb.stats.ConsecutiveFailures >= cb.threshold {
+		cb.stats.Trips++
+		cb.openedAt = cb.now()
+		cb.setState(BreakerOpen)
+	}
+}
+
+// release returns a probe slot of operation which ended neither with success
+// nor with failure
+func (cb *CircuitBreaker) release() {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+
+	if cb.state == BreakerHalfOpen && cb.inFlight > 0 {
+		cb.inFlight--
+	}
+}
+
+// Do runs f if breaker allows it and reports its result
+func (cb *CircuitBreaker) Do(f func() error) error {
+	if err := cb.Allow(); err != nil {
+		return err
+	}
+
+	err := f()
+	if err != nil {
+		cb.Failure()
+	} else {
+		cb.Success()
+	}
+	return err
+}
+
+// retryIn returns how long until breaker lets probes through. While
+// half-open probes are in flight it's a short poll interval, so rejected
+// callers don't spin.
+func (cb *CircuitBreaker) retryIn() time.Duration {
+	cb.l.Lock()
+	defer cb.l.Unlock()
+
+	switch cb.state {
+	case BreakerOpen:
+		return cb.openedAt.Add(cb.timeout).Sub(cb.now())
+	case BreakerHalfOpen:
+		return halfOpenRetry
+	}
+	return 0
+}
+
+// halfOpen moves open breaker to half-open once timeout passes
+func (cb *CircuitBreaker) halfOpen() {
+	if cb.state == BreakerOpen && !cb.now().Before(cb.openedAt.Add(cb.timeout)) {
+		cb.inFlight = 0
+		cb.setState(BreakerHalfOpen)
+	}
+}
+
+func (cb *CircuitBreaker) setState(s BreakerState) {
+	if s == cb.state {
+		return
+	}
+
+	e := BreakerEvent{From: cb.state, To: s, At: cb.now()}
+	cb.state = s
+
+	select {
+	case cb.events <- e:
+	default:
+	}
+}
+
+// ConnectBreaker is a functional option, used to guard connection attempts
+// with circuit breaker. While it's open, Client waits instead of dialing,
+// ErrBreakerOpen is reported to Errors().
+func ConnectBreaker(cb *CircuitBreaker) ClientOpt {
+	return func(c *Client) {
+		c.breaker = cb
+	}
+}
+
+// PublishBreaker is a Publisher's functional option, used to fail publishing
+// fast with ErrBreakerOpen while circuit breaker is open. Publishing errors
+// and waits for connection exceeding ctx deadline count as failures.
+func PublishBreaker(cb *CircuitBreaker) PublisherOpt {
+	return func(p *Publisher) {
+		p.breaker = cb
+	}
+}
+
+// publishResult reports publishing result to circuit breaker. Canceled
+// publishings count neither as success nor as failure.
+func publishResult(cb *CircuitBreaker, err error) {
+	switch err {
+	case nil:
+		cb.Success()
+	case ErrPublisherDead, context.Canceled:
+		cb.release()
+	default:
+		cb.Failure()
+	}
+}
@@ -0,0 +1,182 @@
+// Command conydefs converts RabbitMQ definitions.json into cony declarations.
+//
+// With -format=go it prints a Go source file with a function returning
+// []cony.Declaration for the topology. With -format=json it prints normalized
+// definitions (queues, exchanges and bindings only, sorted by name), which can
+// be diffed against the output of (*cony.Client).Definitions().
+//
+//	conydefs -vhost / -format go -package topology definitions.json
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/assembla/cony"
+)
+
+var (
+	vhost  = flag.String("vhost", "/", "vhost to take definitions from, empty for all")
+	format = flag.String("format", "go", "output format: go or json")
+	pkg    = flag.String("package", "main", "package name of generated Go source")
+	fn     = flag.String("func", "Declarations", "function name of generated Go source")
+)
+
+func main() {
+	flag.Parse()
+
+	in := os.Stdin
+	if flag.NArg() > 0 {
+		f, err := os.Open(flag.Arg(0))
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	defs, err := cony.ReadDefinitions(in, *vhost)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defs.Sort()
+
+	switch *format {
+	case "json":
+		if *vhost != "" {
+			// (*cony.Client).Definitions() knows nothing about vhosts
+			stripVhost(defs)
+		}
+		_, err = defs.WriteTo(os.Stdout)
+	case "go":
+		err = writeGo(os.Stdout, defs)
+	default:
+		err = fmt.Errorf("unknown format %q", *format)
+	}
+
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func stripVhost(defs *cony.Definitions) {
+	for i := range defs.Queues {
+		defs.Queues[i].Vhost = ""
+	}
+	for i := range defs.Exchanges {
+		defs.Exchanges[i].Vhost = ""
+	}
+	for i := range defs.Bindings {
+		defs.Bindings[i].Vhost = ""
+	}
+}
+
+func writeGo(w io.Writer, defs *cony.Definitions) error {
+	var b strings.Builder
+
+	fmt.Fprintf(&b, "// Code generated by conydefs. DO NOT EDIT.\n\n")
+	fmt.Fprintf(&b, "package %s\n\n", *pkg)
+	fmt.Fprintf(&b, "import (\n\t\"github.com/assembla/cony\"\n\tamqp \"github.com/rabbitmq/amqp091-go\"\n)\n\n")
+	fmt.Fprintf(&b, "var _ amqp.Table\n\n")
+	fmt.Fprintf(&b, "// %s returns declarations of the topology\n", *fn)
+	fmt.Fprintf(&b, "func %s() []cony.Declaration {\n", *fn)
+
+	exchanges := make(map[string]string)
+	for i, e := range defs.Exchanges {
+		v := fmt.Sprintf("ex%d", i)
+		exchanges[e.Name] = v
+		fmt.Fprintf(&b, "\t%s := cony.Exchange{Name: %q, Kind: %q, Durable: %t, AutoDelete: %t, Args: %s}\n",
+			v, e.Name, e.Type, e.Durable, e.AutoDelete, table(e.Arguments))
+	}
+
+	queues := make(map[string]string)
+	for i, q := range defs.Queues {
+		v := fmt.Sprintf("q%d", i)
+		queues[q.Name] = v
+		fmt.Fprintf(&b, "\t%s := &cony.Queue{Name: %q, Durable: %t, AutoDelete: %t, Args: %s}\n",
+			v, q.Name, q.Durable, q.AutoDelete, table(q.Arguments))
+	}
+
+	fmt.Fprintf(&b, "\n\treturn []cony.Declaration{\n")
+	for _, e := range defs.Exchanges {
+		fmt.Fprintf(&b, "\t\tcony.DeclareExchange(%s),\n", exchanges[e.Name])
+	}
+	for _, q := range defs.Queues {
+		fmt.Fprintf(&b, "\t\tcony.DeclareQueue(%s),\n", queues[q.Name])
+	}
+	for _, bd := range defs.Bindings {
+		if bd.DestinationType != "queue" {
+			fmt.Fprintf(&b, "\t\t// skipped exchange binding %s -> %s (%q)\n",
+				bd.Source, bd.Destination, bd.RoutingKey)
+			continue
+		}
+
+		q, ok := queues[bd.Destination]
+		if !ok {
+			q = fmt.Sprintf("&cony.Queue{Name: %q}", bd.Destination)
+		}
+		ex, ok := exchanges[bd.Source]
+		if !ok {
+			ex = fmt.Sprintf("cony.Exchange{Name: %q}", bd.Source)
+		}
+
+		fmt.Fprintf(&b, "\t\tcony.DeclareBinding(cony.Binding{Queue: %s, Exchange: %s, Key: %q, Args: %s}),\n",
+			q, ex, bd.RoutingKey, table(bd.Arguments))
+	}
+	fmt.Fprintf(&b, "\t}\n}\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// table renders arguments as amqp.Table literal, nested tables and lists
+// included
+func table(args map[string]interface{}) string {
+	if len(args) == 0 {
+		return "nil"
+	}
+
+	keys := make([]string, 0, len(args))
+	for k := range args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	parts := make([]string, len(keys))
+	for i, k := range keys {
+		parts[i] = fmt.Sprintf("%q: %s", k, value(args[k]))
+	}
+
+	return "amqp.Table{" + strings.Join(parts, ", ") + "}"
+}
+
+func value(v interface{}) string {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		return table(v)
+	case []interface{}:
+		parts := make([]string, len(v))
+		for i := range v {
+			parts[i] = value(v[i])
+		}
+		return "[]interface{}{" + strings.Join(parts, ", ") + "}"
+	case string:
+		return fmt.Sprintf("%q", v)
+	case bool:
+		return fmt.Sprint(v)
+	case nil:
+		return "nil"
+	}
+
+	// json.Number: integral values become int64 like cony.ReadDefinitions does
+	s := fmt.Sprint(v)
+	if strings.ContainsAny(s, ".eE") {
+		return "float64(" + s + ")"
+	}
+	return "int64(" + s + ")"
+}
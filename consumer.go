@@ -1,13 +1,34 @@
 package cony
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/streadway/amqp"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
+// ErrStaleDelivery is returned by Ack(), Nack() and Reject() of a delivery
+// received on a channel which is closed since, e.g. before reconnect. Delivery
+// tags are per channel, so the delivery can't be acknowledged anymore; it is
+// redelivered by the server.
+var ErrStaleDelivery = errors.New("Delivery is from a closed channel")
+
+// CanceledError is reported to (*Consumer).Errors() when the broker cancels
+// the consumer (basic.cancel), e.g. the queue was deleted or mirrored queue
+// failed over. Consumer resubscribes with backoff.
+type CanceledError struct {
+	Queue string
+	Tag   string
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("Consumer %q of queue %q canceled by server", e.Tag, e.Queue)
+}
+
 // ConsumerOpt is a consumer's functional option type
 type ConsumerOpt func(*Consumer)
 
@@ -17,11 +38,27 @@ type Consumer struct {
 	deliveries chan amqp.Delivery
 	errs       chan error
 	qos        int
+	qosSize    int  // prefetch size in bytes
+	qosGlobal  bool // prefetch is shared by all consumers of the channel
+	adaptive   *PrefetchController
+	onCancel   func()    // runs on Cancel() before the channel is closed
+	ch         mqChannel // channel consumer is served on, nil if none
+	generation uint64    // incremented when channel is changed, atomic
+	stale      uint64    // acks of stale deliveries, atomic
+	limiter    *tokenBucket
+	slots      chan struct{} // concurrency slots, see MaxConcurrency
 	tag        string
 	autoAck    bool
 	exclusive  bool
 	noLocal    bool
+	redeclare  bool // re-declare the queue before resubscribing
+	args       amqp.Table
+	stream     bool  // x-stream-offset is set, offset is tracked
+	committed  bool  // offset is set by StreamConsumer, not tracked
+	offset     int64 // offset of the last acknowledged stream message
+	delivered  bool  // offset is known
 	stop       chan struct{}
+	detached   chan struct{} // closed by (*Client).UnregisterConsumer()
 	dead       bool
 	m          sync.Mutex
 }
@@ -51,6 +88,33 @@ func (c *Consumer) Cancel() {
 	}
 }
 
+// attach is called when consumer is registered on a Client. Consumer
+// registered again is detached from its previous serve goroutine first.
+func (c *Consumer) attach() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.detached != nil {
+		close(c.detached)
+	}
+	c.detached = make(chan struct{})
+}
+
+// detach stops serving the consumer, without canceling it
+func (c *Consumer) detach() {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.detached != nil {
+		close(c.detached)
+		c.detached = nil
+	}
+}
+
+func (c *Consumer) detachedChan() <-chan struct{} {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.detached
+}
+
 func (c *Consumer) reportErr(err error) bool {
 	if err != nil {
 		select {
@@ -62,38 +126,339 @@ func (c *Consumer) reportErr(err error) bool {
 	return false
 }
 
+// serve consumes on ch until the consumer is canceled or detached. If only the
+// channel dies (channel exception), it's reopened with backoff on the same
+// connection; serve returns once the connection is gone, consumer is served
+// again after reconnect.
 func (c *Consumer) serve(client mqDeleter, ch mqChannel) {
-	if c.reportErr(ch.Qos(c.qos, 0, false)) {
-		return
+	detached := c.detachedChan()
+
+	redeclare := false // broker canceled the consumer, queue may be gone
+
+	for attempt := 0; ; attempt++ {
+		stopped, consumed, canceled := c.consume(client, ch, detached)
+		if stopped {
+			return
+		}
+
+		if consumed {
+			attempt = 0
+		}
+		redeclare = redeclare || canceled
+
+		var err error
+		ch, err = reopenChannel(client, attempt, c.stop, detached)
+		switch err {
+		case nil:
+			if redeclare {
+				c.redeclareQueue(ch)
+				redeclare = false
+			}
+		case errStopped:
+			c.stopped(client, detached)
+			return
+		case ErrNoConnection:
+			return
+		default:
+			c.reportErr(err)
+			ch = nil
+		}
+	}
+}
+
+// consume delivers from ch. It returns stopped once the consumer is canceled or
+// detached, consumed tells whether consuming was started before the channel
+// died, canceled whether it died as the server canceled the consumer.
+func (c *Consumer) consume(client mqDeleter, ch mqChannel, detached <-chan struct{}) (stopped, consumed, canceled bool) {
+	if ch == nil {
+		return false, false, false
+	}
+
+	if c.reportErr(c.applyQos(ch)) {
+		return false, false, false
 	}
 
-	deliveries, err2 := ch.Consume(c.q.Name,
+	deliveries, err2 := ch.Consume(c.q.name(),
 		c.tag,       // consumer tag
 		c.autoAck,   // autoAck,
 		c.exclusive, // exclusive,
 		c.noLocal,   // noLocal,
 		false,       // noWait,
-		nil,         // args Table
+		c.consumeArgs(),
 	)
 	if c.reportErr(err2) {
-		return
+		return false, false, false
+	}
+
+	c.setChannel(ch)
+	defer c.clearChannel(ch)
+
+	// deliveries of this channel become stale once it's gone. Serving on a
+	// newer channel may start before this one returns, e.g. while it's
+	// blocked handing over a delivery, its generation is left intact then.
+	gen := atomic.AddUint64(&c.generation, 1)
+	gone := make(chan struct{})
+	defer func() {
+		atomic.CompareAndSwapUint64(&c.generation, gen, gen+1)
+		close(gone)
+	}()
+
+	// slots of unacknowledged deliveries are freed once channel is gone
+	var ledger *slotLedger
+	if !c.autoAck {
+		ledger = newSlotLedger(c.slots)
+		defer ledger.close()
 	}
 
+	// server sends basic.cancel when the queue is deleted or fails over
+	cancels := ch.NotifyCancel(make(chan string, 1))
+
 	for {
 		select {
 		case <-c.stop:
+			if c.onCancel != nil {
+				c.onCancel()
+			}
 			client.deleteConsumer(c)
 			ch.Close()
-			return
+			return true, true, false
+		case <-detached:
+			ch.Close()
+			return true, true, false
+		case tag := <-cancels:
+			c.canceled(ch, tag)
+			return false, true, true
 		case d, ok := <-deliveries: // deliveries will be closed once channel is closed (disconnected from network)
 			if !ok {
-				return
+				// deliveries are closed right after cancel notification
+				select {
+				case tag := <-cancels:
+					c.canceled(ch, tag)
+					return false, true, true
+				default:
+				}
+				return false, true, false
+			}
+			held := ledger
+			if d.Acknowledger != nil {
+				g := &staleGuard{Acknowledger: d.Acknowledger, c: c, gen: gen, gone: gone, ledger: ledger}
+				if c.stream && !c.committed {
+					g.offset, g.tracked = streamOffset(d)
+				}
+				d.Acknowledger = g
+			} else {
+				held = nil // nothing would free the slot
+			}
+
+			if !c.throttle(d.DeliveryTag, held, detached) {
+				// not handed over, redelivered once channel is closed
+				continue
 			}
 			c.deliveries <- d
 		}
 	}
 }
 
+// StaleAcks returns number of Ack(), Nack() and Reject() calls on stale
+// deliveries, see ErrStaleDelivery
+func (c *Consumer) StaleAcks() uint64 {
+	return atomic.LoadUint64(&c.stale)
+}
+
+// staleGuard acknowledges deliveries only while their channel is in use
+type staleGuard struct {
+	amqp.Acknowledger
+	c      *Consumer
+	gen    uint64
+	gone   <-chan struct{} // closed once the channel is gone
+	ledger *slotLedger
+
+	offset  int64 // stream offset, tracked once acknowledged
+	tracked bool
+}
+
+// channelGone returns channel closed once channel of delivery d is gone, nil
+// if it's unknown
+func channelGone(d amqp.Delivery) <-chan struct{} {
+	if g, ok := d.Acknowledger.(*staleGuard); ok {
+		return g.gone
+	}
+	return nil
+}
+
+func (g *staleGuard) isStale() bool {
+	if atomic.LoadUint64(&g.c.generation) != g.gen {
+		atomic.AddUint64(&g.c.stale, 1)
+		return true
+	}
+	return false
+}
+
+func (g *staleGuard) Ack(tag uint64, multiple bool) error {
+	if g.isStale() {
+		return ErrStaleDelivery
+	}
+	defer g.ledger.settle(tag, multiple)
+
+	err := g.Acknowledger.Ack(tag, multiple)
+	if err == nil && g.tracked {
+		g.c.track(g.offset)
+	}
+	return err
+}
+
+func (g *staleGuard) Nack(tag uint64, multiple bool, requeue bool) error {
+	if g.isStale() {
+		return ErrStaleDelivery
+	}
+	defer g.ledger.settle(tag, multiple)
+	return g.Acknowledger.Nack(tag, multiple, requeue)
+}
+
+func (g *staleGuard) Reject(tag uint64, requeue bool) error {
+	if g.isStale() {
+		return ErrStaleDelivery
+	}
+	defer g.ledger.settle(tag, false)
+	return g.Acknowledger.Reject(tag, requeue)
+}
+
+// canceled reports broker initiated cancel, the channel is closed and
+// consumer resubscribes on a new one
+func (c *Consumer) canceled(ch mqChannel, tag string) {
+	c.reportErr(&CanceledError{Queue: c.q.name(), Tag: tag})
+	ch.Close()
+}
+
+// redeclareQueue declares the queue on the channel reopened after broker
+// initiated cancel, if RedeclareOnCancel option is set
+func (c *Consumer) redeclareQueue(ch mqChannel) {
+	if !c.redeclare {
+		return
+	}
+
+	if d, ok := ch.(Declarer); ok {
+		c.reportErr(DeclareQueue(c.q)(d))
+	}
+}
+
+func (c *Consumer) setChannel(ch mqChannel) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.ch = ch
+}
+
+// clearChannel forgets ch unless serving on a newer channel already started
+func (c *Consumer) clearChannel(ch mqChannel) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if c.ch == ch {
+		c.ch = nil
+	}
+}
+
+// applyQos sets prefetch on ch
+func (c *Consumer) applyQos(ch mqChannel) error {
+	c.m.Lock()
+	count, size, global := c.qos, c.qosSize, c.qosGlobal
+	c.m.Unlock()
+
+	return ch.Qos(count, size, global)
+}
+
+// SetQos changes prefetch count of the consumer, it's kept for channels
+// opened later. On the live channel it's applied right away, without
+// cancelling the consumer, with global flag: RabbitMQ applies per-consumer
+// prefetch only to consumers started after basic.qos, while channel prefetch
+// applies to running ones, and consumer has the channel to itself. Unless
+// GlobalQos is set, prefetch the consumer was started with still caps it, so
+// the change is limited to lowering prefetch until the consumer is served on
+// a new channel.
+func (c *Consumer) SetQos(count int) error {
+	c.m.Lock()
+	c.qos = count
+	ch, size := c.ch, c.qosSize
+	c.m.Unlock()
+
+	if ch == nil {
+		return nil
+	}
+	return ch.Qos(count, size, true)
+}
+
+// consumeArgs returns consumer arguments, stream offset is moved past the last
+// acknowledged message once there is one
+func (c *Consumer) consumeArgs() amqp.Table {
+	c.m.Lock()
+	defer c.m.Unlock()
+
+	if c.args == nil {
+		return nil
+	}
+
+	args := amqp.Table{}
+	for k, v := range c.args {
+		args[k] = v
+	}
+
+	if c.stream && c.delivered {
+		args["x-stream-offset"] = c.offset + 1
+	}
+	return args
+}
+
+// track remembers stream offset of acknowledged message. Offset only moves
+// forward, messages processed concurrently should be acknowledged in order,
+// otherwise unprocessed ones before the last acknowledged are skipped on
+// resume.
+func (c *Consumer) track(offset int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	if !c.delivered || offset > c.offset {
+		c.offset, c.delivered = offset, true
+	}
+}
+
+// setOffset sets offset to resume after
+func (c *Consumer) setOffset(offset int64) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	c.offset, c.delivered = offset, true
+}
+
+// StreamOffset returns offset of the last stream message acknowledged with
+// Ack(), false if there was none yet. Consumer resumes after it when it's
+// served again, e.g. after reconnect, so messages handed over but not
+// processed are delivered again.
+func (c *Consumer) StreamOffset() (int64, bool) {
+	c.m.Lock()
+	defer c.m.Unlock()
+	return c.offset, c.delivered
+}
+
+// streamOffset returns x-stream-offset header of a stream message
+func streamOffset(d amqp.Delivery) (int64, bool) {
+	switch v := d.Headers["x-stream-offset"].(type) {
+	case int64:
+		return v, true
+	case int32:
+		return int64(v), true
+	case int:
+		return int64(v), true
+	}
+	return 0, false
+}
+
+// stopped finishes serving, once consumer was canceled or detached while its
+// channel was being reopened
+func (c *Consumer) stopped(client mqDeleter, detached <-chan struct{}) {
+	select {
+	case <-detached:
+	default:
+		client.deleteConsumer(c)
+	}
+}
+
 // NewConsumer Consumer's constructor
 func NewConsumer(q *Queue, opts ...ConsumerOpt) *Consumer {
 	c := &Consumer{
@@ -105,6 +470,9 @@ func NewConsumer(q *Queue, opts ...ConsumerOpt) *Consumer {
 	for _, o := range opts {
 		o(c)
 	}
+	if c.adaptive != nil {
+		c.qos = c.adaptive.clamp(c.qos)
+	}
 	return c
 }
 
@@ -115,6 +483,25 @@ func Qos(count int) ConsumerOpt {
 	}
 }
 
+// PrefetchSize limits unacknowledged deliveries by their total size in bytes,
+// in addition to Qos count. It's for brokers other than RabbitMQ: RabbitMQ
+// refuses non-zero size with NOT_IMPLEMENTED (540), a connection error, so the
+// connection is closed with all its consumers and publishers, and again on
+// every reconnect.
+func PrefetchSize(size int) ConsumerOpt {
+	return func(c *Consumer) {
+		c.qosSize = size
+	}
+}
+
+// GlobalQos applies prefetch to the whole channel (global flag of basic.qos)
+// instead of to the consumer
+func GlobalQos() ConsumerOpt {
+	return func(c *Consumer) {
+		c.qosGlobal = true
+	}
+}
+
 // Tag the consumer
 func Tag(tag string) ConsumerOpt {
 	return func(c *Consumer) {
@@ -146,9 +533,79 @@ func Exclusive() ConsumerOpt {
 	}
 }
 
+// RedeclareOnCancel re-declares the queue before resubscribing after the
+// server canceled the consumer (basic.cancel), e.g. as the queue was deleted.
+// Channels reopened for other reasons don't re-declare the queue.
+func RedeclareOnCancel() ConsumerOpt {
+	return func(c *Consumer) {
+		c.redeclare = true
+	}
+}
+
 // NoLocal set this consumer in NoLocal mode.
 func NoLocal() ConsumerOpt {
 	return func(c *Consumer) {
 		c.noLocal = true
 	}
 }
+
+// ConsumerArgs sets consumer arguments, e.g. x-cancel-on-ha-failover. It
+// could be combined with Priority() and StreamOffsetAt options.
+func ConsumerArgs(args amqp.Table) ConsumerOpt {
+	return func(c *Consumer) {
+		for k, v := range args {
+			c.setArg(k, v)
+		}
+	}
+}
+
+// Priority sets consumer priority (x-priority), consumers with higher
+// priority get messages first
+func Priority(priority int) ConsumerOpt {
+	return func(c *Consumer) {
+		c.setArg("x-priority", int32(priority))
+	}
+}
+
+// StreamOffsetFirst starts consuming a stream from the first available message
+func StreamOffsetFirst() ConsumerOpt {
+	return streamOffsetOpt("first")
+}
+
+// StreamOffsetLast starts consuming a stream from the last written chunk
+func StreamOffsetLast() ConsumerOpt {
+	return streamOffsetOpt("last")
+}
+
+// StreamOffsetNext starts consuming a stream from the next message written
+// after consumer starts
+func StreamOffsetNext() ConsumerOpt {
+	return streamOffsetOpt("next")
+}
+
+// StreamOffsetTimestamp starts consuming a stream from messages written at t
+// or later (with chunk granularity)
+func StreamOffsetTimestamp(t time.Time) ConsumerOpt {
+	return streamOffsetOpt(t)
+}
+
+// StreamOffsetAt starts consuming a stream from the message with offset
+func StreamOffsetAt(offset int64) ConsumerOpt {
+	return streamOffsetOpt(offset)
+}
+
+// streamOffsetOpt sets x-stream-offset, offset of delivered messages is
+// tracked, so consumer resumes after the last one when served again
+func streamOffsetOpt(offset interface{}) ConsumerOpt {
+	return func(c *Consumer) {
+		c.setArg("x-stream-offset", offset)
+		c.stream = true
+	}
+}
+
+func (c *Consumer) setArg(key string, value interface{}) {
+	if c.args == nil {
+		c.args = amqp.Table{}
+	}
+	c.args[key] = value
+}
@@ -3,10 +3,11 @@ package cony
 import (
 	"bytes"
 	"errors"
+	"sync"
 	"testing"
 	"time"
 
-	"github.com/streadway/amqp"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 func TestAutoAck(t *testing.T) {
@@ -156,7 +157,7 @@ func TestConsumer_serve_qos(t *testing.T) {
 
 	go func() {
 		<-runSync
-		c.serve(nil, ch1)
+		c.serve(&mqDeleterTest{}, ch1)
 		runSync <- true
 	}()
 
@@ -192,7 +193,7 @@ func TestConsumer_serve_Consume(t *testing.T) {
 
 	go func() {
 		<-runSync
-		c.serve(nil, ch1)
+		c.serve(&mqDeleterTest{}, ch1)
 		runSync <- true
 	}()
 
@@ -320,3 +321,690 @@ func newTestConsumer(opts ...ConsumerOpt) *Consumer {
 	q := &Queue{}
 	return NewConsumer(q, opts...)
 }
+
+func TestConsumer_serve_detach(t *testing.T) {
+	var (
+		closed     bool
+		consuming  = make(chan bool)
+		done       = make(chan bool)
+		deliveries = make(chan amqp.Delivery)
+	)
+
+	c := newTestConsumer()
+	c.attach()
+
+	ch1 := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+			consuming <- true
+			return deliveries, nil
+		},
+		_Close: func() error {
+			closed = true
+			return nil
+		},
+	}
+
+	go func() {
+		c.serve(&mqDeleterTest{}, ch1)
+		done <- true
+	}()
+
+	<-consuming
+	c.detach()
+	<-done
+
+	if !closed {
+		t.Error("should close channel")
+	}
+
+	select {
+	case <-c.stop:
+		t.Error("should not cancel consumer")
+	default:
+	}
+}
+
+func TestConsumer_serve_reopen(t *testing.T) {
+	var (
+		reopened    = make(chan bool, 1)
+		done        = make(chan bool)
+		deliveries1 = make(chan amqp.Delivery)
+		deliveries2 = make(chan amqp.Delivery)
+		reopenErr   = errors.New("reopen")
+	)
+
+	newCh := func(deliveries chan amqp.Delivery) *mqChannelTest {
+		return &mqChannelTest{
+			_Qos: func(int, int, bool) error {
+				return nil
+			},
+			_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+				return deliveries, nil
+			},
+			_Close: func() error {
+				return nil
+			},
+		}
+	}
+
+	var attempts int
+	cli := &mqDeleterTest{
+		_deleteConsumer: func(*Consumer) {},
+		_reopenChannel: func() (mqChannel, error) {
+			attempts++
+			switch attempts {
+			case 1:
+				return nil, reopenErr
+			case 2:
+				reopened <- true
+				return newCh(deliveries2), nil
+			}
+			return nil, ErrNoConnection
+		},
+	}
+
+	c := newTestConsumer()
+	c.attach()
+
+	go func() {
+		c.serve(cli, newCh(deliveries1))
+		done <- true
+	}()
+
+	close(deliveries1) // imitate channel exception
+
+	if err := <-c.Errors(); err != reopenErr {
+		t.Error("should report reopen error, got", err)
+	}
+
+	<-reopened
+	deliveries2 <- amqp.Delivery{Body: []byte("test2")}
+	if msg := <-c.Deliveries(); string(msg.Body) != "test2" {
+		t.Error("should consume on reopened channel")
+	}
+
+	close(deliveries2) // connection is gone this time
+	<-done
+
+	if attempts != 3 {
+		t.Error("should stop reopening once connection is gone, attempts", attempts)
+	}
+}
+
+func TestConsumer_serve_reopen_cancel(t *testing.T) {
+	var (
+		deleted = make(chan bool, 1)
+		done    = make(chan bool)
+	)
+
+	cli := &mqDeleterTest{
+		_deleteConsumer: func(*Consumer) {
+			deleted <- true
+		},
+		_reopenChannel: func() (mqChannel, error) {
+			return nil, errors.New("channel")
+		},
+	}
+
+	c := newTestConsumer()
+	c.attach()
+
+	ch1 := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return errors.New("qos")
+		},
+	}
+
+	go func() {
+		c.serve(cli, ch1)
+		done <- true
+	}()
+
+	<-c.Errors()
+	<-c.Errors()
+	c.Cancel()
+	<-done
+
+	select {
+	case <-deleted:
+	default:
+		t.Error("should delete consumer canceled while reopening")
+	}
+}
+
+func TestConsumer_args(t *testing.T) {
+	c := newTestConsumer(
+		ConsumerArgs(amqp.Table{"x-cancel-on-ha-failover": true}),
+		Priority(10),
+	)
+
+	args := c.consumeArgs()
+	if args["x-priority"] != int32(10) || args["x-cancel-on-ha-failover"] != true {
+		t.Error("should pass consumer args, got", args)
+	}
+
+	if newTestConsumer().consumeArgs() != nil {
+		t.Error("should pass nil args by default")
+	}
+
+	ts := time.Unix(1000, 0)
+	tab := []struct {
+		opt    ConsumerOpt
+		offset interface{}
+	}{
+		{StreamOffsetFirst(), "first"},
+		{StreamOffsetLast(), "last"},
+		{StreamOffsetNext(), "next"},
+		{StreamOffsetTimestamp(ts), ts},
+		{StreamOffsetAt(42), int64(42)},
+	}
+
+	for _, spec := range tab {
+		if offset := newTestConsumer(spec.opt).consumeArgs()["x-stream-offset"]; offset != spec.offset {
+			t.Errorf("should set x-stream-offset %v, got %v", spec.offset, offset)
+		}
+	}
+}
+
+func TestConsumer_serve_streamOffset(t *testing.T) {
+	var (
+		args       = make(chan amqp.Table, 2)
+		done       = make(chan bool)
+		deliveries = make(chan amqp.Delivery)
+	)
+
+	c := newTestConsumer(StreamOffsetFirst(), Qos(10))
+	c.attach()
+
+	newCh := func() *mqChannelTest {
+		return &mqChannelTest{
+			_Qos: func(int, int, bool) error {
+				return nil
+			},
+			_Consume: func(_ string, _ string, _ bool, _ bool, _ bool, _ bool, a amqp.Table) (<-chan amqp.Delivery, error) {
+				args <- a
+				return deliveries, nil
+			},
+			_Close: func() error {
+				return nil
+			},
+		}
+	}
+
+	cli := &mqDeleterTest{
+		_reopenChannel: func() (mqChannel, error) {
+			deliveries = make(chan amqp.Delivery)
+			return newCh(), nil
+		},
+	}
+
+	go func() {
+		c.serve(cli, newCh())
+		done <- true
+	}()
+
+	if a := <-args; a["x-stream-offset"] != "first" {
+		t.Error("should start from the first message, got", a)
+	}
+
+	ack := &testAcknowledger{}
+	deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, Headers: amqp.Table{"x-stream-offset": int64(7)}}
+	d7 := <-c.Deliveries()
+	deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 2, Headers: amqp.Table{"x-stream-offset": int64(8)}}
+	d8 := <-c.Deliveries()
+	deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 3}
+	<-c.Deliveries()
+
+	if _, ok := c.StreamOffset(); ok {
+		t.Error("should not track offset of message which is not processed yet")
+	}
+
+	d8.Ack(false)
+	d7.Ack(false)
+
+	if offset, ok := c.StreamOffset(); !ok || offset != 8 {
+		t.Error("should track the last acknowledged offset, got", offset)
+	}
+
+	close(deliveries)
+
+	if a := <-args; a["x-stream-offset"] != int64(9) {
+		t.Error("should resume after the last acknowledged message, got", a)
+	}
+
+	c.detach()
+	<-done
+}
+
+// qosChannel imitates RabbitMQ prefetch: per-consumer prefetch is fixed when
+// consuming starts, channel (global) prefetch applies to running consumers
+type qosChannel struct {
+	mqChannelTest
+	deliveries   chan amqp.Delivery
+	next         int // per-consumer prefetch for consumers started later
+	consumer     int
+	channel      int
+	size         int
+	consumeStart chan bool
+	l            sync.Mutex
+}
+
+func newQosChannel() *qosChannel {
+	ch := &qosChannel{
+		deliveries:   make(chan amqp.Delivery),
+		consumeStart: make(chan bool, 1),
+	}
+	ch._Close = func() error {
+		return nil
+	}
+	return ch
+}
+
+func (ch *qosChannel) Qos(count, size int, global bool) error {
+	ch.l.Lock()
+	defer ch.l.Unlock()
+	if global {
+		ch.channel = count
+	} else {
+		ch.next = count
+	}
+	ch.size = size
+	return nil
+}
+
+func (ch *qosChannel) Consume(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+	ch.l.Lock()
+	ch.consumer = ch.next
+	ch.l.Unlock()
+	ch.consumeStart <- true
+	return ch.deliveries, nil
+}
+
+// prefetch returns effective prefetch of the running consumer, 0 if unlimited
+func (ch *qosChannel) prefetch() int {
+	ch.l.Lock()
+	defer ch.l.Unlock()
+	switch {
+	case ch.consumer == 0:
+		return ch.channel
+	case ch.channel == 0 || ch.consumer < ch.channel:
+		return ch.consumer
+	}
+	return ch.channel
+}
+
+func TestConsumer_SetQos(t *testing.T) {
+	c := newTestConsumer(Qos(10), PrefetchSize(4096), GlobalQos())
+	c.attach()
+
+	if err := c.SetQos(20); err != nil {
+		t.Error("should keep prefetch until consumer is served, got", err)
+	}
+
+	ch1 := newQosChannel()
+	done := make(chan bool)
+	go func() {
+		c.serve(&mqDeleterTest{}, ch1)
+		done <- true
+	}()
+	<-ch1.consumeStart
+
+	if p := ch1.prefetch(); p != 20 || ch1.size != 4096 {
+		t.Error("should apply prefetch options, got", p, ch1.size)
+	}
+
+	c.SetQos(50)
+	if p := ch1.prefetch(); p != 50 {
+		t.Error("should raise prefetch of running consumer, got", p)
+	}
+
+	c.SetQos(5)
+	if p := ch1.prefetch(); p != 5 {
+		t.Error("should lower prefetch of running consumer, got", p)
+	}
+
+	c.detach()
+	<-done
+}
+
+func TestConsumer_SetQos_overlap(t *testing.T) {
+	c := newTestConsumer(GlobalQos())
+	c.attach()
+
+	ch1 := newQosChannel()
+	ch2 := newQosChannel()
+	done1 := make(chan bool)
+	done2 := make(chan bool)
+
+	go func() {
+		c.serve(&mqDeleterTest{}, ch1)
+		done1 <- true
+	}()
+	<-ch1.consumeStart
+
+	// the first serve goroutine blocks handing over the delivery
+	ch1.deliveries <- amqp.Delivery{DeliveryTag: 1}
+
+	// consumer is registered again and served on a new channel meanwhile
+	c.attach()
+	go func() {
+		c.serve(&mqDeleterTest{}, ch2)
+		done2 <- true
+	}()
+	<-ch2.consumeStart
+
+	<-c.Deliveries()
+	<-done1
+
+	c.SetQos(30)
+	if p := ch2.prefetch(); p != 30 {
+		t.Error("should set prefetch of the live channel once the old one is gone, got", p)
+	}
+
+	if p := ch1.prefetch(); p != 0 {
+		t.Error("should not set prefetch of the old channel, got", p)
+	}
+
+	c.detach()
+	<-done2
+}
+
+func TestConsumer_SetQos_perConsumer(t *testing.T) {
+	c := newTestConsumer(Qos(10))
+	c.attach()
+
+	ch1 := newQosChannel()
+	ch2 := newQosChannel()
+	cli := &mqDeleterTest{
+		_reopenChannel: func() (mqChannel, error) {
+			return ch2, nil
+		},
+	}
+
+	done := make(chan bool)
+	go func() {
+		c.serve(cli, ch1)
+		done <- true
+	}()
+	<-ch1.consumeStart
+
+	c.SetQos(5)
+	if p := ch1.prefetch(); p != 5 {
+		t.Error("should lower prefetch of running consumer, got", p)
+	}
+
+	c.SetQos(20)
+	if p := ch1.prefetch(); p != 10 {
+		t.Error("prefetch of running consumer should be capped by initial one, got", p)
+	}
+
+	// channel exception, consumer is served on a new channel
+	close(ch1.deliveries)
+	<-ch2.consumeStart
+
+	if p := ch2.prefetch(); p != 20 {
+		t.Error("should start on new channel with changed prefetch, got", p)
+	}
+
+	c.detach()
+	<-done
+}
+
+func TestConsumer_serve_cancel(t *testing.T) {
+	var (
+		done        = make(chan bool)
+		cancels     = make(chan chan string, 1)
+		closed      = make(chan bool, 1)
+		declared    = make(chan string, 1)
+		deliveries1 = make(chan amqp.Delivery)
+		deliveries2 = make(chan amqp.Delivery)
+	)
+
+	ch1 := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+			return deliveries1, nil
+		},
+		_NotifyCancel: func(c chan string) chan string {
+			cancels <- c
+			return c
+		},
+		_Close: func() error {
+			closed <- true
+			return nil
+		},
+	}
+
+	ch2 := newTestPoolChannel()
+	ch2._Qos = func(int, int, bool) error {
+		return nil
+	}
+	ch2._Consume = func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+		return deliveries2, nil
+	}
+	ch2._QueueDeclare = func(name string) (amqp.Queue, error) {
+		declared <- name
+		return amqp.Queue{Name: name}, nil
+	}
+
+	cli := &mqDeleterTest{
+		_reopenChannel: func() (mqChannel, error) {
+			return ch2, nil
+		},
+	}
+
+	c := NewConsumer(&Queue{Name: "q1"}, Tag("tag1"), RedeclareOnCancel())
+	c.attach()
+
+	go func() {
+		c.serve(cli, ch1)
+		done <- true
+	}()
+
+	(<-cancels) <- "tag1"
+
+	err, ok := (<-c.Errors()).(*CanceledError)
+	if !ok || err.Queue != "q1" || err.Tag != "tag1" {
+		t.Error("should report CanceledError, got", err)
+	}
+
+	<-closed
+
+	if name := <-declared; name != "q1" {
+		t.Error("should re-declare the queue, got", name)
+	}
+
+	deliveries2 <- amqp.Delivery{Body: []byte("test2")}
+	if msg := <-c.Deliveries(); string(msg.Body) != "test2" {
+		t.Error("should resubscribe")
+	}
+
+	c.detach()
+	<-done
+}
+
+func TestConsumer_staleDelivery_overlap(t *testing.T) {
+	var (
+		done1       = make(chan bool)
+		done2       = make(chan bool)
+		consuming2  = make(chan bool)
+		deliveries1 = make(chan amqp.Delivery)
+		deliveries2 = make(chan amqp.Delivery)
+		ack         = &testAcknowledger{}
+	)
+
+	newCh := func(deliveries chan amqp.Delivery, consuming chan bool) *mqChannelTest {
+		return &mqChannelTest{
+			_Qos: func(int, int, bool) error {
+				return nil
+			},
+			_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+				if consuming != nil {
+					consuming <- true
+				}
+				return deliveries, nil
+			},
+			_Close: func() error {
+				return nil
+			},
+		}
+	}
+
+	c := newTestConsumer()
+	c.attach()
+
+	go func() {
+		c.serve(&mqDeleterTest{}, newCh(deliveries1, nil))
+		done1 <- true
+	}()
+
+	// the first serve goroutine blocks handing over the delivery
+	deliveries1 <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+
+	// consumer is registered again and served on a new channel meanwhile
+	c.attach()
+	go func() {
+		c.serve(&mqDeleterTest{}, newCh(deliveries2, consuming2))
+		done2 <- true
+	}()
+	<-consuming2
+
+	d1 := <-c.Deliveries()
+	<-done1
+
+	deliveries2 <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+	d2 := <-c.Deliveries()
+
+	if err := d2.Ack(false); err != nil {
+		t.Error("delivery of the live channel should be acknowledged, got", err)
+	}
+
+	if err := d1.Ack(false); err != ErrStaleDelivery {
+		t.Error("delivery of the old channel should be stale, got", err)
+	}
+
+	c.detach()
+	<-done2
+}
+
+func TestConsumer_serve_redeclareOnlyOnCancel(t *testing.T) {
+	var (
+		done        = make(chan bool)
+		declared    = make(chan string, 1)
+		deliveries1 = make(chan amqp.Delivery)
+		deliveries2 = make(chan amqp.Delivery)
+	)
+
+	ch1 := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+			return deliveries1, nil
+		},
+		_Close: func() error {
+			return nil
+		},
+	}
+
+	ch2 := newTestPoolChannel()
+	ch2._Qos = func(int, int, bool) error {
+		return nil
+	}
+	ch2._Consume = func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+		return deliveries2, nil
+	}
+	ch2._QueueDeclare = func(name string) (amqp.Queue, error) {
+		declared <- name
+		return amqp.Queue{Name: name}, nil
+	}
+
+	cli := &mqDeleterTest{
+		_reopenChannel: func() (mqChannel, error) {
+			return ch2, nil
+		},
+	}
+
+	c := NewConsumer(&Queue{Name: "q1"}, RedeclareOnCancel())
+	c.attach()
+
+	go func() {
+		c.serve(cli, ch1)
+		done <- true
+	}()
+
+	// channel exception, the consumer was not canceled
+	close(deliveries1)
+
+	deliveries2 <- amqp.Delivery{Body: []byte("test2")}
+	if msg := <-c.Deliveries(); string(msg.Body) != "test2" {
+		t.Error("should resubscribe")
+	}
+
+	select {
+	case name := <-declared:
+		t.Error("should not re-declare the queue without cancel, got", name)
+	default:
+	}
+
+	c.detach()
+	<-done
+}
+
+func TestConsumer_staleDelivery(t *testing.T) {
+	var (
+		done       = make(chan bool)
+		deliveries = make(chan amqp.Delivery)
+		ack        = &testAcknowledger{}
+	)
+
+	c := newTestConsumer()
+	ch1 := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+			return deliveries, nil
+		},
+	}
+
+	go func() {
+		c.serve(&mqDeleterTest{}, ch1)
+		done <- true
+	}()
+
+	deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+	d1 := <-c.Deliveries()
+	deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 2}
+	d2 := <-c.Deliveries()
+
+	if err := d1.Ack(false); err != nil || len(ack.acked) != 1 {
+		t.Error("should ack delivery of live channel, got", err)
+	}
+
+	close(deliveries) // channel is gone
+	<-done
+
+	if err := d2.Ack(false); err != ErrStaleDelivery {
+		t.Error("should not ack stale delivery, got", err)
+	}
+	if err := d2.Nack(false, true); err != ErrStaleDelivery {
+		t.Error("should not nack stale delivery, got", err)
+	}
+	if err := d2.Reject(true); err != ErrStaleDelivery {
+		t.Error("should not reject stale delivery, got", err)
+	}
+
+	if len(ack.acked) != 1 {
+		t.Error("should not pass stale ack to the channel")
+	}
+
+	if c.StaleAcks() != 3 {
+		t.Error("should count stale acks, got", c.StaleAcks())
+	}
+}
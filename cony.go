@@ -1,12 +1,14 @@
-// Package cony is a high-level wrapper around http://github.com/streadway/amqp library,
+// Package cony is a high-level wrapper around https://github.com/rabbitmq/amqp091-go library,
 // for working declaratively with AMQP. Cony will manage AMQP
 // connect/reconnect to AMQP broker, along with recovery of consumers.
 package cony
 
 import (
+	"errors"
 	"sync"
+	"time"
 
-	"github.com/streadway/amqp"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 // Queue hold definition of AMQP queue
@@ -17,7 +19,47 @@ type Queue struct {
 	Exclusive  bool
 	Args       amqp.Table
 
-	l sync.Mutex
+	renamed []chan string
+	l       sync.Mutex
+}
+
+// NotifyRename registers a listener for queue name changes. Server named
+// queues get a new name every time they are declared, i.e. on every reconnect.
+// New name is sent after it's set and before consumers of the queue are
+// started again. Message is dropped if the channel is not ready to receive,
+// so buffered channel is recommended.
+func (q *Queue) NotifyRename(c chan string) chan string {
+	q.l.Lock()
+	defer q.l.Unlock()
+	q.renamed = append(q.renamed, c)
+	return c
+}
+
+// name returns current queue name, which is updated by DeclareQueue for
+// server named queues
+func (q *Queue) name() string {
+	q.l.Lock()
+	defer q.l.Unlock()
+	return q.Name
+}
+
+// setName updates queue name with the one server replied with and notifies
+// listeners if it has changed
+func (q *Queue) setName(name string) {
+	q.l.Lock()
+	defer q.l.Unlock()
+
+	if q.Name == name {
+		return
+	}
+	q.Name = name
+
+	for _, c := range q.renamed {
+		select {
+		case c <- name:
+		default:
+		}
+	}
 }
 
 // Exchange hold definition of AMQP exchange
@@ -40,12 +82,39 @@ type Binding struct {
 type mqDeleter interface {
 	deletePublisher(*Publisher)
 	deleteConsumer(*Consumer)
+	// reopenChannel opens a channel instead of the one closed by channel
+	// exception, it returns ErrNoConnection if the connection is gone
+	reopenChannel() (mqChannel, error)
+	backoff() Backoffer
+}
+
+// errStopped is returned by reopenChannel once consumer or publisher is
+// canceled or detached
+var errStopped = errors.New("stopped")
+
+// reopenChannel reopens channel of a consumer or publisher with backoff,
+// while the connection stays up. attempt is the number of failed attempts in
+// a row. errStopped is returned once stop or detached are closed meanwhile.
+func reopenChannel(client mqDeleter, attempt int, stop, detached <-chan struct{}) (mqChannel, error) {
+	t := time.NewTimer(client.backoff().Backoff(attempt))
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+	case <-stop:
+		return nil, errStopped
+	case <-detached:
+		return nil, errStopped
+	}
+
+	return client.reopenChannel()
 }
 
 type mqChannel interface {
 	Close() error
 	Consume(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error)
 	NotifyClose(chan *amqp.Error) chan *amqp.Error
+	NotifyCancel(chan string) chan string
 	Publish(string, string, bool, bool, amqp.Publishing) error
 	Qos(int, int, bool) error
 }
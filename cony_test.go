@@ -1,10 +1,17 @@
 package cony
 
-import "github.com/streadway/amqp"
+import (
+	"fmt"
+	"sync"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
 
 type mqDeleterTest struct {
 	_deletePublisher func(*Publisher)
 	_deleteConsumer  func(*Consumer)
+	_reopenChannel   func() (mqChannel, error)
 }
 
 func (m *mqDeleterTest) deletePublisher(p *Publisher) {
@@ -15,12 +22,24 @@ func (m *mqDeleterTest) deleteConsumer(c *Consumer) {
 	m._deleteConsumer(c)
 }
 
+func (m *mqDeleterTest) reopenChannel() (mqChannel, error) {
+	if m._reopenChannel == nil {
+		return nil, ErrNoConnection
+	}
+	return m._reopenChannel()
+}
+
+func (m *mqDeleterTest) backoff() Backoffer {
+	return testBackoff(0)
+}
+
 type mqChannelTest struct {
-	_Close       func() error
-	_Consume     func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error)
-	_NotifyClose func(chan *amqp.Error) chan *amqp.Error
-	_Publish     func(string, string, bool, bool, amqp.Publishing) error
-	_Qos         func(int, int, bool) error
+	_Close        func() error
+	_Consume      func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error)
+	_NotifyClose  func(chan *amqp.Error) chan *amqp.Error
+	_NotifyCancel func(chan string) chan string
+	_Publish      func(string, string, bool, bool, amqp.Publishing) error
+	_Qos          func(int, int, bool) error
 }
 
 func (m *mqChannelTest) Close() error {
@@ -35,6 +54,13 @@ func (m *mqChannelTest) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
 	return m._NotifyClose(c)
 }
 
+func (m *mqChannelTest) NotifyCancel(c chan string) chan string {
+	if m._NotifyCancel == nil {
+		return c
+	}
+	return m._NotifyCancel(c)
+}
+
 func (m *mqChannelTest) Publish(exchange string, key string, mandatory bool, immediate bool, msg amqp.Publishing) error {
 	return m._Publish(exchange, key, mandatory, immediate, msg)
 }
@@ -42,3 +68,83 @@ func (m *mqChannelTest) Publish(exchange string, key string, mandatory bool, imm
 func (m *mqChannelTest) Qos(prefetchCount int, prefetchSize int, global bool) error {
 	return m._Qos(prefetchCount, prefetchSize, global)
 }
+
+func TestQueue_NotifyRename(t *testing.T) {
+	var n int
+
+	q := &Queue{Exclusive: true} // server named
+	renamed := q.NotifyRename(make(chan string, 2))
+
+	td := &testDeclarer{
+		_QueueDeclare: func(name string) (amqp.Queue, error) {
+			if name != "" {
+				t.Error("server named queue should be re-declared with empty name")
+			}
+			n++
+			return amqp.Queue{Name: fmt.Sprintf("amq.gen-%d", n)}, nil
+		},
+	}
+
+	declare := DeclareQueue(q)
+	declare(td)
+	declare(td) // reconnect
+
+	if name := <-renamed; name != "amq.gen-1" {
+		t.Error("should notify about the first name, got", name)
+	}
+
+	if name := <-renamed; name != "amq.gen-2" {
+		t.Error("should notify about the new name, got", name)
+	}
+
+	q.setName("amq.gen-2")
+	select {
+	case name := <-renamed:
+		t.Error("should not notify if name is the same, got", name)
+	default:
+	}
+}
+
+// should be run with -race
+func TestQueue_name_race(t *testing.T) {
+	var (
+		wg    sync.WaitGroup
+		q     = &Queue{}
+		bound = make(chan string, 100)
+	)
+
+	td := &testDeclarer{
+		_QueueDeclare: func(name string) (amqp.Queue, error) {
+			return amqp.Queue{Name: "amq.gen-X"}, nil
+		},
+	}
+	bindTd := &testTopologyDeclarer{
+		queueBind: func(name, key, exchange string) error {
+			bound <- name
+			return nil
+		},
+	}
+
+	declareQueue := DeclareQueue(q)
+	declareBinding := DeclareBinding(Binding{Queue: q, Exchange: Exchange{Name: "amq.topic"}})
+
+	for i := 0; i < 50; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			declareQueue(td)
+		}()
+		go func() {
+			defer wg.Done()
+			declareBinding(bindTd)
+		}()
+	}
+	wg.Wait()
+	close(bound)
+
+	for name := range bound {
+		if name != "" && name != "amq.gen-X" {
+			t.Error("binding should see either old or new name, got", name)
+		}
+	}
+}
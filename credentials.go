@@ -0,0 +1,255 @@
+package cony
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	// credentialsRefreshMargin is how long before expiry credentials are
+	// refreshed
+	credentialsRefreshMargin = 30 * time.Second
+
+	// credentialsRetry is how soon failed refresh is retried
+	credentialsRetry = 5 * time.Second
+)
+
+// ErrNoCredentials is returned by CredentialsProvider when credentials are
+// not available
+var ErrNoCredentials = errors.New("No credentials available")
+
+// Credentials are username and password used to authenticate a connection.
+// Expiry is zero for credentials which don't expire.
+type Credentials struct {
+	Username string
+	Password string
+	Expiry   time.Time
+}
+
+// CredentialsProvider returns credentials for the next connection. It's
+// consulted on every dial, and ahead of expiry of current credentials to
+// update the secret of the open connection, see CredentialsFrom.
+type CredentialsProvider interface {
+	Credentials(ctx context.Context) (Credentials, error)
+}
+
+// CredentialsFunc is an adapter to use ordinary function as
+// CredentialsProvider
+type CredentialsFunc func(ctx context.Context) (Credentials, error)
+
+// Credentials implements CredentialsProvider
+func (f CredentialsFunc) Credentials(ctx context.Context) (Credentials, error) {
+	return f(ctx)
+}
+
+// FileCredentials reads username and password from files (e.g. secrets
+// mounted into container), files are re-read on every dial. Trailing
+// whitespace is trimmed.
+func FileCredentials(usernameFile, passwordFile string) CredentialsProvider {
+	return CredentialsFunc(func(ctx context.Context) (Credentials, error) {
+		username, err := os.ReadFile(usernameFile)
+		if err != nil {
+			return Credentials{}, err
+		}
+
+		password, err := os.ReadFile(passwordFile)
+		if err != nil {
+			return Credentials{}, err
+		}
+
+		return Credentials{
+			Username: strings.TrimSpace(string(username)),
+			Password: strings.TrimSpace(string(password)),
+		}, nil
+	})
+}
+
+// EnvCredentials reads username and password from environment variables on
+// every dial. ErrNoCredentials is returned if password variable is not set.
+func EnvCredentials(usernameVar, passwordVar string) CredentialsProvider {
+	return CredentialsFunc(func(ctx context.Context) (Credentials, error) {
+		password, ok := os.LookupEnv(passwordVar)
+		if !ok {
+			return Credentials{}, ErrNoCredentials
+		}
+
+		return Credentials{
+			Username: os.Getenv(usernameVar),
+			Password: password,
+		}, nil
+	})
+}
+
+// OAuth2Credentials obtains access tokens with OAuth2 client credentials
+// grant, for RabbitMQ OAuth 2.0 plugin. The token is passed as password, it's
+// cached and refreshed shortly before expiry.
+type OAuth2Credentials struct {
+	TokenURL     string
+	ClientID     string
+	ClientSecret string
+	Scopes       []string
+	Username     string       // ignored by RabbitMQ, some proxies need it
+	HTTPClient   *http.Client // http.DefaultClient if nil
+
+	token Credentials
+	l     sync.Mutex
+}
+
+// Credentials implements CredentialsProvider
+func (o *OAuth2Credentials) Credentials(ctx context.Context) (Credentials, error) {
+	o.l.Lock()
+	defer o.l.Unlock()
+
+	if o.token.Password != "" && !needsRefresh(o.token) {
+		return o.token, nil
+	}
+
+	token, err := o.fetch(ctx)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	o.token = token
+	return token, nil
+}
+
+func (o *OAuth2Credentials) fetch(ctx context.Context) (Credentials, error) {
+	form := url.Values{"grant_type": {"client_credentials"}}
+	if len(o.Scopes) > 0 {
+		form.Set("scope", strings.Join(o.Scopes, " "))
+	}
+
+	req, err := http.NewRequest("POST", o.TokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return Credentials{}, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(url.QueryEscape(o.ClientID), url.QueryEscape(o.ClientSecret))
+
+	client := o.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return Credentials{}, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return Credentials{}, fmt.Errorf("cony: token endpoint returned %s", resp.Status)
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int64  `json:"expires_in"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		return Credentials{}, err
+	}
+
+	if token.AccessToken == "" {
+		return Credentials{}, ErrNoCredentials
+	}
+
+	creds := Credentials{
+		Username: o.Username,
+		Password: token.AccessToken,
+	}
+	if token.ExpiresIn > 0 {
+		creds.Expiry = time.Now().Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+
+	return creds, nil
+}
+
+func needsRefresh(creds Credentials) bool {
+	return !creds.Expiry.IsZero() &&
+		time.Now().Add(credentialsRefreshMargin).After(creds.Expiry)
+}
+
+// refreshDelay returns when credentials expiring at expiry should be
+// refreshed, never sooner than in a second
+func refreshDelay(expiry time.Time) time.Duration {
+	d := time.Until(expiry) - credentialsRefreshMargin
+	if d < time.Second {
+		d = time.Second
+	}
+	return d
+}
+
+// applyCredentials sets credentials from the provider for the next dial
+func (c *Client) applyCredentials(ctx context.Context, config *amqp.Config) (Credentials, error) {
+	if c.creds == nil {
+		return Credentials{}, nil
+	}
+
+	creds, err := c.creds.Credentials(ctx)
+	if err != nil {
+		return Credentials{}, err
+	}
+
+	// certificate authenticates the connection, there's no secret to refresh
+	if c.tls != nil && c.tls.external {
+		return Credentials{}, nil
+	}
+
+	config.SASL = []amqp.Authentication{&amqp.PlainAuth{
+		Username: creds.Username,
+		Password: creds.Password,
+	}}
+
+	return creds, nil
+}
+
+// secretUpdater is implemented by *amqp.Connection
+type secretUpdater interface {
+	UpdateSecret(newSecret, reason string) error
+}
+
+// refreshSecret fetches credentials ahead of expiry of the current ones and
+// updates the secret of the open connection (connection.update-secret). It
+// returns how soon to refresh again, zero if fresh credentials don't expire.
+// If they are not available, refresh is retried in credentialsRetry, as
+// current credentials may be still valid. Error is returned if the secret
+// can't be updated, the connection has to be re-established then.
+func (c *Client) refreshSecret(conn secretUpdater) (time.Duration, error) {
+	creds, err := c.creds.Credentials(context.Background())
+	if c.reportErr(err) {
+		return credentialsRetry, nil
+	}
+
+	if err := conn.UpdateSecret(creds.Password, "credentials refresh"); err != nil {
+		return 0, err
+	}
+
+	if creds.Expiry.IsZero() {
+		return 0, nil
+	}
+	return refreshDelay(creds.Expiry), nil
+}
+
+// CredentialsFrom is a functional option, used to get username and password
+// from the provider on every dial instead of URL. Shortly before credentials
+// expire, fresh password is set on the open connection with
+// connection.update-secret (RabbitMQ 3.10+), consumers and publishers keep
+// running. Username can't be changed this way. If fresh credentials are not
+// available yet, refresh is retried in a few seconds. If the broker refuses
+// the update, the connection is re-established with fresh credentials.
+func CredentialsFrom(p CredentialsProvider) ClientOpt {
+	return func(c *Client) {
+		c.creds = p
+	}
+}
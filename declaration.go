@@ -1,8 +1,33 @@
 package cony
 
-import "github.com/streadway/amqp"
+import (
+	"errors"
+	"fmt"
 
-// Declaration is a callback type to declare AMQP queue/exchange/binding
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	// ErrMissingDeclaration is returned by (*Client).Declare() when a binding
+	// refers to a queue or an exchange which is never declared
+	ErrMissingDeclaration = errors.New("Declaration depends on undeclared entity")
+
+	// ErrDeclarationCycle is returned by (*Client).Declare() when declarations
+	// depend on each other
+	ErrDeclarationCycle = errors.New("Declarations have cyclic dependencies")
+
+	// ErrDeclarationInUse is returned by (*DeclarationHandle).Remove() when
+	// other declarations registered on the Client depend on removed ones
+	ErrDeclarationInUse = errors.New("Declaration is in use")
+)
+
+// Declaration is a callback type to declare AMQP queue/exchange/binding.
+//
+// Declarations are also run when they're registered with (*Client).Declare()
+// and by (*Client).Definitions(), against a Declarer which doesn't talk to the
+// server, to find out their dependencies. They shouldn't have other side
+// effects. Declarations which panic there, e.g. type asserting *amqp.Channel,
+// are treated as having no dependencies and are left out of Definitions().
 type Declaration func(Declarer) error
 
 // Declarer is implemented by *amqp.Channel
@@ -12,22 +37,38 @@ type Declarer interface {
 	QueueBind(name, key, exchange string, noWait bool, args amqp.Table) error
 }
 
+// inspector is implemented by Declarers which only look at declarations
+// without sending them to the server. DeclareQueue and DeclareBinding hand
+// them cony objects instead of calling Declarer methods, so server named
+// queues could be tracked by identity and Queue names stay untouched.
+type inspector interface {
+	Declarer
+	inspectQueue(q *Queue, name string)
+	inspectBinding(b Binding)
+	inspectSubscription(s *Subscription)
+}
+
 // DeclareQueue is a way to declare AMQP queue
 func DeclareQueue(q *Queue) Declaration {
 	name := q.Name
 	return func(c Declarer) error {
-		q.Name = name
-		realQ, err := c.QueueDeclare(q.Name,
+		if in, ok := c.(inspector); ok {
+			in.inspectQueue(q, name)
+			return nil
+		}
+
+		realQ, err := c.QueueDeclare(name,
 			q.Durable,
 			q.AutoDelete,
 			q.Exclusive,
 			false,
 			q.Args,
 		)
-		q.l.Lock()
-		q.Name = realQ.Name
-		q.l.Unlock()
-		return err
+		if err != nil {
+			return err
+		}
+		q.setName(realQ.Name)
+		return nil
 	}
 }
 
@@ -48,7 +89,12 @@ func DeclareExchange(e Exchange) Declaration {
 // DeclareBinding is a way to declare AMQP binding between AMQP queue and exchange
 func DeclareBinding(b Binding) Declaration {
 	return func(c Declarer) error {
-		return c.QueueBind(b.Queue.Name,
+		if in, ok := c.(inspector); ok {
+			in.inspectBinding(b)
+			return nil
+		}
+
+		return c.QueueBind(b.Queue.name(),
 			b.Key,
 			b.Exchange.Name,
 			false,
@@ -56,3 +102,215 @@ func DeclareBinding(b Binding) Declaration {
 		)
 	}
 }
+
+// DeclarationHandle refers to declarations registered by (*Client).Declare()
+type DeclarationHandle struct {
+	client *Client
+	ds     []*declaration
+}
+
+// Remove unregisters declarations from the Client, so they are not re-run on
+// reconnect. Queues, exchanges and bindings are not deleted on the server.
+// Returns ErrDeclarationInUse if remaining declarations depend on removed
+// ones, e.g. queue can't be removed while its binding is still declared.
+func (h *DeclarationHandle) Remove() error {
+	return h.client.removeDeclarations(h.ds)
+}
+
+// resource is a queue or an exchange, declaration creates or depends on.
+// Queues declared with DeclareQueue carry their *Queue, as the name of server
+// named queue is not known upfront.
+type resource struct {
+	kind string
+	name string
+	q    *Queue
+}
+
+func (r resource) String() string {
+	if r.name == "" {
+		return "server named " + r.kind
+	}
+	return fmt.Sprintf("%s %q", r.kind, r.name)
+}
+
+// satisfiedBy reports whether provided resource p is the one r depends on
+func (r resource) satisfiedBy(p resource) bool {
+	if r.kind != p.kind {
+		return false
+	}
+
+	if r.q != nil && r.q == p.q {
+		return true
+	}
+
+	return p.name != "" && p.name == r.name
+}
+
+// declaration is a Declaration registered on a Client along with what it
+// creates and what it depends on
+type declaration struct {
+	declare  Declaration
+	provides []resource
+	requires []resource
+}
+
+// newDeclaration inspects Declaration to find out its dependencies
+func newDeclaration(d Declaration) *declaration {
+	dep := &dependencyInspector{}
+	if !dryRun(d, dep) {
+		return &declaration{declare: d}
+	}
+
+	return &declaration{
+		declare:  d,
+		provides: dep.provides,
+		requires: dep.requires,
+	}
+}
+
+// dryRun runs d against inspector in, it returns false if d panics, e.g. when
+// it needs a real channel
+func dryRun(d Declaration, in inspector) (ok bool) {
+	defer func() {
+		if recover() != nil {
+			ok = false
+		}
+	}()
+
+	d(in)
+	return true
+}
+
+// dependencyInspector is a Declarer which collects resources declarations
+// create and depend on
+type dependencyInspector struct {
+	provides []resource
+	requires []resource
+}
+
+func (di *dependencyInspector) inspectQueue(q *Queue, name string) {
+	di.provides = append(di.provides, resource{kind: "queue", name: name, q: q})
+}
+
+func (di *dependencyInspector) inspectBinding(b Binding) {
+	di.requires = append(di.requires,
+		resource{kind: "queue", name: b.Queue.name(), q: b.Queue},
+		resource{kind: "exchange", name: b.Exchange.Name},
+	)
+}
+
+// inspectSubscription makes subscription depend on its queue and exchange,
+// even when it has no keys yet
+func (di *dependencyInspector) inspectSubscription(s *Subscription) {
+	di.inspectBinding(Binding{Queue: s.q, Exchange: s.ex})
+}
+
+func (di *dependencyInspector) QueueDeclare(name string, durable, autoDelete,
+	exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	di.provides = append(di.provides, resource{kind: "queue", name: name})
+	return amqp.Queue{Name: name}, nil
+}
+
+func (di *dependencyInspector) ExchangeDeclare(name, kind string, durable,
+	autoDelete, internal, noWait bool, args amqp.Table) error {
+	di.provides = append(di.provides, resource{kind: "exchange", name: name})
+	return nil
+}
+
+func (di *dependencyInspector) QueueBind(name, key, exchange string,
+	noWait bool, args amqp.Table) error {
+	di.requires = append(di.requires,
+		resource{kind: "queue", name: name},
+		resource{kind: "exchange", name: exchange},
+	)
+	return nil
+}
+
+// sortDeclarations orders declarations so every declaration goes after the
+// ones it depends on, otherwise keeping the original order. It fails if a
+// dependency is never declared or declarations depend on each other.
+func sortDeclarations(ds []*declaration) ([]*declaration, error) {
+	deps := make([][]int, len(ds)) // deps[i] are indexes declaration i depends on
+
+	for i, d := range ds {
+		for _, r := range d.requires {
+			if r.kind == "exchange" && predefinedExchange(r.name) {
+				continue
+			}
+
+			if provides(d, r) || providesOwnServerNamed(d, r) {
+				continue
+			}
+
+			found := false
+			for j, p := range ds {
+				if j != i && provides(p, r) {
+					deps[i] = append(deps[i], j)
+					found = true
+				}
+			}
+
+			if !found {
+				return nil, fmt.Errorf("%w: %s", ErrMissingDeclaration, r)
+			}
+		}
+	}
+
+	var (
+		sorted = make([]*declaration, 0, len(ds))
+		done   = make([]bool, len(ds))
+	)
+
+	for len(sorted) < len(ds) {
+		next := -1
+		for i := range ds {
+			if !done[i] && allDone(deps[i], done) {
+				next = i
+				break
+			}
+		}
+
+		if next < 0 {
+			return nil, ErrDeclarationCycle
+		}
+
+		done[next] = true
+		sorted = append(sorted, ds[next])
+	}
+
+	return sorted, nil
+}
+
+func provides(d *declaration, r resource) bool {
+	for _, p := range d.provides {
+		if r.satisfiedBy(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// providesOwnServerNamed reports whether r is a server named queue declared
+// by d itself. Custom Declaration may bind the queue it has just declared by
+// the name returned from QueueDeclare(), which is unknown upfront.
+func providesOwnServerNamed(d *declaration, r resource) bool {
+	if r.kind != "queue" || r.name != "" || r.q != nil {
+		return false
+	}
+
+	for _, p := range d.provides {
+		if p.kind == "queue" && p.name == "" && p.q == nil {
+			return true
+		}
+	}
+	return false
+}
+
+func allDone(idx []int, done []bool) bool {
+	for _, i := range idx {
+		if !done[i] {
+			return false
+		}
+	}
+	return true
+}
@@ -1,9 +1,10 @@
 package cony
 
 import (
+	"errors"
 	"testing"
 
-	"github.com/streadway/amqp"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 type testDeclarer struct {
@@ -105,3 +106,112 @@ func TestDeclareBinding(t *testing.T) {
 		t.Error("DeclareBinding() should call declarer.QueueBind()")
 	}
 }
+
+func TestSortDeclarations(t *testing.T) {
+	q := &Queue{} // server named
+	ex := Exchange{Name: "ex1"}
+
+	bnd := newDeclaration(DeclareBinding(Binding{Queue: q, Exchange: ex}))
+	queue := newDeclaration(DeclareQueue(q))
+	exchange := newDeclaration(DeclareExchange(ex))
+	// custom declaration, inspected through Declarer calls
+	custom := newDeclaration(func(c Declarer) error {
+		return c.QueueBind("q2", "key", "amq.topic", false, nil)
+	})
+	q2 := newDeclaration(DeclareQueue(&Queue{Name: "q2"}))
+
+	sorted, err := sortDeclarations([]*declaration{bnd, custom, queue, exchange, q2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*declaration{queue, exchange, bnd, q2, custom}
+	for i := range expected {
+		if sorted[i] != expected[i] {
+			t.Fatalf("declaration %d is out of order", i)
+		}
+	}
+}
+
+func TestSortDeclarations_missing(t *testing.T) {
+	q := &Queue{Name: "q1"}
+	ex := Exchange{Name: "ex1"}
+
+	_, err := sortDeclarations([]*declaration{
+		newDeclaration(DeclareQueue(q)),
+		newDeclaration(DeclareBinding(Binding{Queue: q, Exchange: ex})),
+	})
+	if !errors.Is(err, ErrMissingDeclaration) {
+		t.Error("should report missing exchange, got", err)
+	}
+
+	_, err = sortDeclarations([]*declaration{
+		newDeclaration(DeclareBinding(Binding{Queue: &Queue{}, Exchange: Exchange{Name: "amq.direct"}})),
+	})
+	if !errors.Is(err, ErrMissingDeclaration) {
+		t.Error("should report missing server named queue, got", err)
+	}
+}
+
+func TestSortDeclarations_customServerNamed(t *testing.T) {
+	custom := newDeclaration(func(c Declarer) error {
+		q, err := c.QueueDeclare("", false, true, true, false, nil)
+		if err != nil {
+			return err
+		}
+		return c.QueueBind(q.Name, "key", "amq.topic", false, nil)
+	})
+
+	if _, err := sortDeclarations([]*declaration{custom}); err != nil {
+		t.Error("custom declaration binding its own server named queue should be valid, got", err)
+	}
+
+	// other declarations can't refer to that queue
+	other := newDeclaration(func(c Declarer) error {
+		return c.QueueBind("", "key", "amq.topic", false, nil)
+	})
+	if _, err := sortDeclarations([]*declaration{custom, other}); !errors.Is(err, ErrMissingDeclaration) {
+		t.Error("should report missing server named queue, got", err)
+	}
+}
+
+func TestClient_Declare_channelDeclaration(t *testing.T) {
+	c := NewClient()
+	q := &Queue{Name: "q1"}
+
+	// declaration which needs a real channel panics during inspection
+	exchangeBind := func(d Declarer) error {
+		if _, err := d.QueueDeclare("q2", false, false, false, false, nil); err != nil {
+			return err
+		}
+		return d.(*amqp.Channel).ExchangeBind("ex1", "key", "ex2", false, nil)
+	}
+
+	_, err := c.Declare([]Declaration{exchangeBind, DeclareQueue(q)})
+	if err != nil {
+		t.Fatal("should register declaration without dependencies, got", err)
+	}
+
+	if len(c.declarations) != 2 {
+		t.Fatal("should keep both declarations, got", len(c.declarations))
+	}
+
+	if d := newDeclaration(exchangeBind); d.provides != nil || d.requires != nil {
+		t.Error("should drop dependencies found before panic, got", d.provides, d.requires)
+	}
+}
+
+func TestSortDeclarations_cycle(t *testing.T) {
+	a := &declaration{
+		provides: []resource{{kind: "exchange", name: "a"}},
+		requires: []resource{{kind: "exchange", name: "b"}},
+	}
+	b := &declaration{
+		provides: []resource{{kind: "exchange", name: "b"}},
+		requires: []resource{{kind: "exchange", name: "a"}},
+	}
+
+	if _, err := sortDeclarations([]*declaration{a, b}); err != ErrDeclarationCycle {
+		t.Error("should detect cycle, got", err)
+	}
+}
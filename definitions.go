@@ -0,0 +1,342 @@
+package cony
+
+import (
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// Definitions is a topology in the format of RabbitMQ management plugin
+// definitions.json. Only queues, exchanges and bindings are handled, other
+// sections (users, vhosts, policies...) are ignored on import and omitted on
+// export.
+type Definitions struct {
+	Queues    []QueueDefinition    `json:"queues"`
+	Exchanges []ExchangeDefinition `json:"exchanges"`
+	Bindings  []BindingDefinition  `json:"bindings"`
+}
+
+// QueueDefinition is a queue entry of definitions.json
+type QueueDefinition struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost,omitempty"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// ExchangeDefinition is an exchange entry of definitions.json
+type ExchangeDefinition struct {
+	Name       string                 `json:"name"`
+	Vhost      string                 `json:"vhost,omitempty"`
+	Type       string                 `json:"type"`
+	Durable    bool                   `json:"durable"`
+	AutoDelete bool                   `json:"auto_delete"`
+	Internal   bool                   `json:"internal"`
+	Arguments  map[string]interface{} `json:"arguments"`
+}
+
+// BindingDefinition is a binding entry of definitions.json
+type BindingDefinition struct {
+	Source          string                 `json:"source"`
+	Vhost           string                 `json:"vhost,omitempty"`
+	Destination     string                 `json:"destination"`
+	DestinationType string                 `json:"destination_type"`
+	RoutingKey      string                 `json:"routing_key"`
+	Arguments       map[string]interface{} `json:"arguments"`
+}
+
+// ReadDefinitions parses definitions.json exported by RabbitMQ management
+// plugin. When vhost is not empty, only entries of that vhost are kept.
+func ReadDefinitions(r io.Reader, vhost string) (*Definitions, error) {
+	var defs Definitions
+
+	dec := json.NewDecoder(r)
+	dec.UseNumber()
+	if err := dec.Decode(&defs); err != nil {
+		return nil, err
+	}
+
+	if vhost != "" {
+		defs = defs.vhost(vhost)
+	}
+
+	return &defs, nil
+}
+
+// WriteTo writes definitions as definitions.json, suitable for import with
+// management plugin or `rabbitmqadmin import`
+func (d *Definitions) WriteTo(w io.Writer) (int64, error) {
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := w.Write(append(b, '\n'))
+	return int64(n), err
+}
+
+// Declarations converts definitions into cony declarations: exchanges first,
+// then queues, then bindings. Exchange to exchange bindings are skipped, as
+// cony doesn't declare them.
+func (d *Definitions) Declarations() []Declaration {
+	var (
+		ds       []Declaration
+		queues   = make(map[string]*Queue)
+		exchange = make(map[string]Exchange)
+	)
+
+	for _, e := range d.Exchanges {
+		ex := Exchange{
+			Name:       e.Name,
+			Kind:       e.Type,
+			Durable:    e.Durable,
+			AutoDelete: e.AutoDelete,
+			Args:       toTable(e.Arguments),
+		}
+		exchange[e.Name] = ex
+		ds = append(ds, DeclareExchange(ex))
+	}
+
+	for _, qd := range d.Queues {
+		q := &Queue{
+			Name:       qd.Name,
+			Durable:    qd.Durable,
+			AutoDelete: qd.AutoDelete,
+			Args:       toTable(qd.Arguments),
+		}
+		queues[qd.Name] = q
+		ds = append(ds, DeclareQueue(q))
+	}
+
+	for _, b := range d.Bindings {
+		if b.DestinationType != "queue" {
+			continue
+		}
+
+		q, ok := queues[b.Destination]
+		if !ok {
+			q = &Queue{Name: b.Destination}
+		}
+
+		ex, ok := exchange[b.Source]
+		if !ok {
+			ex = Exchange{Name: b.Source}
+		}
+
+		ds = append(ds, DeclareBinding(Binding{
+			Queue:    q,
+			Exchange: ex,
+			Key:      b.RoutingKey,
+			Args:     toTable(b.Arguments),
+		}))
+	}
+
+	return ds
+}
+
+// Sort orders definitions by name, so two dumps of the same topology can be
+// compared line by line
+func (d *Definitions) Sort() {
+	sort.Slice(d.Queues, func(i, j int) bool {
+		return d.Queues[i].Name < d.Queues[j].Name
+	})
+	sort.Slice(d.Exchanges, func(i, j int) bool {
+		return d.Exchanges[i].Name < d.Exchanges[j].Name
+	})
+	sort.Slice(d.Bindings, func(i, j int) bool {
+		a, b := d.Bindings[i], d.Bindings[j]
+		if a.Source != b.Source {
+			return a.Source < b.Source
+		}
+		if a.Destination != b.Destination {
+			return a.Destination < b.Destination
+		}
+		return a.RoutingKey < b.RoutingKey
+	})
+}
+
+func (d Definitions) vhost(name string) Definitions {
+	var res Definitions
+
+	for _, q := range d.Queues {
+		if q.Vhost == name {
+			res.Queues = append(res.Queues, q)
+		}
+	}
+
+	for _, e := range d.Exchanges {
+		if e.Vhost == name {
+			res.Exchanges = append(res.Exchanges, e)
+		}
+	}
+
+	for _, b := range d.Bindings {
+		if b.Vhost == name {
+			res.Bindings = append(res.Bindings, b)
+		}
+	}
+
+	return res
+}
+
+// Definitions dumps declarations registered on the Client as definitions.
+// Declarations are not sent to the server, they are run against a recorder.
+// Declarations which panic there, e.g. type asserting *amqp.Channel, are left
+// out.
+// Server named queues, predefined exchanges (default and amq.*) and bindings
+// of server named queues are left out, as they can't be part of
+// definitions.json.
+func (c *Client) Definitions() *Definitions {
+	c.l.Lock()
+	defer c.l.Unlock()
+
+	rec := &definitionsRecorder{}
+	for _, d := range c.declarations {
+		defs := rec.defs
+		if !dryRun(d.declare, rec) {
+			// drop what was recorded before it panicked
+			rec.defs = defs
+		}
+	}
+
+	return &rec.defs
+}
+
+// definitionsRecorder is a Declarer which collects definitions instead of
+// declaring them
+type definitionsRecorder struct {
+	defs Definitions
+}
+
+func (r *definitionsRecorder) inspectQueue(q *Queue, name string) {
+	if !serverNamed(name) && !q.Exclusive {
+		r.defs.Queues = append(r.defs.Queues, QueueDefinition{
+			Name:       name,
+			Durable:    q.Durable,
+			AutoDelete: q.AutoDelete,
+			Arguments:  fromTable(q.Args),
+		})
+	}
+}
+
+func (r *definitionsRecorder) inspectBinding(b Binding) {
+	r.QueueBind(b.Queue.name(), b.Key, b.Exchange.Name, false, b.Args)
+}
+
+func (r *definitionsRecorder) inspectSubscription(s *Subscription) {
+	for _, b := range s.bindings() {
+		r.inspectBinding(b)
+	}
+}
+
+func (r *definitionsRecorder) QueueDeclare(name string, durable, autoDelete,
+	exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	if !serverNamed(name) && !exclusive {
+		r.defs.Queues = append(r.defs.Queues, QueueDefinition{
+			Name:       name,
+			Durable:    durable,
+			AutoDelete: autoDelete,
+			Arguments:  fromTable(args),
+		})
+	}
+
+	return amqp.Queue{Name: name}, nil
+}
+
+func (r *definitionsRecorder) ExchangeDeclare(name, kind string, durable,
+	autoDelete, internal, noWait bool, args amqp.Table) error {
+	if !predefinedExchange(name) {
+		r.defs.Exchanges = append(r.defs.Exchanges, ExchangeDefinition{
+			Name:       name,
+			Type:       kind,
+			Durable:    durable,
+			AutoDelete: autoDelete,
+			Internal:   internal,
+			Arguments:  fromTable(args),
+		})
+	}
+
+	return nil
+}
+
+func (r *definitionsRecorder) QueueBind(name, key, exchange string,
+	noWait bool, args amqp.Table) error {
+	if !serverNamed(name) {
+		r.defs.Bindings = append(r.defs.Bindings, BindingDefinition{
+			Source:          exchange,
+			Destination:     name,
+			DestinationType: "queue",
+			RoutingKey:      key,
+			Arguments:       fromTable(args),
+		})
+	}
+
+	return nil
+}
+
+func serverNamed(queue string) bool {
+	return queue == "" || strings.HasPrefix(queue, "amq.gen-")
+}
+
+func predefinedExchange(name string) bool {
+	return name == "" || strings.HasPrefix(name, "amq.")
+}
+
+// toTable converts decoded JSON arguments into amqp.Table. Integral numbers
+// become int64, as RabbitMQ expects long values for arguments like
+// x-message-ttl or x-max-length.
+func toTable(args map[string]interface{}) amqp.Table {
+	if len(args) == 0 {
+		return nil
+	}
+
+	t := make(amqp.Table, len(args))
+	for k, v := range args {
+		t[k] = toTableValue(v)
+	}
+
+	return t
+}
+
+func toTableValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		f, _ := v.Float64()
+		return f
+	case float64:
+		if v == float64(int64(v)) {
+			return int64(v)
+		}
+		return v
+	case map[string]interface{}:
+		return toTable(v)
+	case []interface{}:
+		res := make([]interface{}, len(v))
+		for i := range v {
+			res[i] = toTableValue(v[i])
+		}
+		return res
+	}
+
+	return v
+}
+
+func fromTable(t amqp.Table) map[string]interface{} {
+	args := make(map[string]interface{}, len(t))
+	for k, v := range t {
+		if nested, ok := v.(amqp.Table); ok {
+			args[k] = fromTable(nested)
+			continue
+		}
+		args[k] = v
+	}
+
+	return args
+}
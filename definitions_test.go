@@ -0,0 +1,204 @@
+package cony
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const testDefinitions = `{
+  "rabbit_version": "3.8.9",
+  "users": [{"name": "guest"}],
+  "queues": [
+    {"name": "q1", "vhost": "/", "durable": true, "auto_delete": false,
+     "arguments": {"x-message-ttl": 60000, "x-queue-type": "classic"}},
+    {"name": "q2", "vhost": "other", "durable": false, "auto_delete": true,
+     "arguments": {}}
+  ],
+  "exchanges": [
+    {"name": "ex1", "vhost": "/", "type": "topic", "durable": true,
+     "auto_delete": false, "internal": false, "arguments": {}}
+  ],
+  "bindings": [
+    {"source": "ex1", "vhost": "/", "destination": "q1",
+     "destination_type": "queue", "routing_key": "a.#", "arguments": {}},
+    {"source": "ex1", "vhost": "/", "destination": "ex2",
+     "destination_type": "exchange", "routing_key": "b.#", "arguments": {}}
+  ]
+}`
+
+func TestReadDefinitions(t *testing.T) {
+	defs, err := ReadDefinitions(strings.NewReader(testDefinitions), "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(defs.Queues) != 1 || defs.Queues[0].Name != "q1" {
+		t.Error("should keep only queues of requested vhost")
+	}
+
+	if len(defs.Exchanges) != 1 || len(defs.Bindings) != 2 {
+		t.Error("should read exchanges and bindings")
+	}
+
+	all, err := ReadDefinitions(strings.NewReader(testDefinitions), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(all.Queues) != 2 {
+		t.Error("should keep all vhosts if vhost is empty")
+	}
+
+	if _, err := ReadDefinitions(strings.NewReader("{"), ""); err == nil {
+		t.Error("should report malformed json")
+	}
+}
+
+func TestDefinitions_Declarations(t *testing.T) {
+	var (
+		queues    []string
+		exchanges []string
+		bindings  []string
+		ttl       interface{}
+	)
+
+	defs, _ := ReadDefinitions(strings.NewReader(testDefinitions), "/")
+
+	td := &testTopologyDeclarer{
+		queueDeclare: func(name string, args amqp.Table) (amqp.Queue, error) {
+			queues = append(queues, name)
+			ttl = args["x-message-ttl"]
+			return amqp.Queue{Name: name}, nil
+		},
+		exchangeDeclare: func(name, kind string) error {
+			exchanges = append(exchanges, name+":"+kind)
+			return nil
+		},
+		queueBind: func(name, key, exchange string) error {
+			bindings = append(bindings, exchange+"->"+name+":"+key)
+			return nil
+		},
+	}
+
+	for _, declare := range defs.Declarations() {
+		declare(td)
+	}
+
+	if len(exchanges) != 1 || exchanges[0] != "ex1:topic" {
+		t.Error("should declare exchanges, got", exchanges)
+	}
+
+	if len(queues) != 1 || queues[0] != "q1" {
+		t.Error("should declare queues, got", queues)
+	}
+
+	if _, ok := ttl.(int64); !ok {
+		t.Errorf("integral arguments should be int64, got %T", ttl)
+	}
+
+	if len(bindings) != 1 || bindings[0] != "ex1->q1:a.#" {
+		t.Error("should declare queue bindings only, got", bindings)
+	}
+}
+
+func TestClient_Definitions(t *testing.T) {
+	c := NewClient()
+
+	named := &Queue{Name: "q1", Durable: true, Args: amqp.Table{"x-max-length": int64(10)}}
+	serverNamed := &Queue{Name: "amq.gen-123"}
+	ex := Exchange{Name: "ex1", Kind: "fanout"}
+
+	c.Declare([]Declaration{
+		DeclareQueue(named),
+		DeclareQueue(serverNamed),
+		DeclareExchange(ex),
+		DeclareExchange(Exchange{Name: "amq.topic", Kind: "topic"}),
+		DeclareBinding(Binding{Queue: named, Exchange: ex, Key: "k1"}),
+		DeclareBinding(Binding{Queue: serverNamed, Exchange: ex, Key: "k2"}),
+	})
+
+	defs := c.Definitions()
+
+	if len(defs.Queues) != 1 || defs.Queues[0].Name != "q1" || !defs.Queues[0].Durable {
+		t.Error("should dump named queues only, got", defs.Queues)
+	}
+
+	if defs.Queues[0].Arguments["x-max-length"] != int64(10) {
+		t.Error("should dump queue arguments")
+	}
+
+	if len(defs.Exchanges) != 1 || defs.Exchanges[0].Type != "fanout" {
+		t.Error("should skip predefined exchanges, got", defs.Exchanges)
+	}
+
+	if len(defs.Bindings) != 1 || defs.Bindings[0].RoutingKey != "k1" {
+		t.Error("should skip bindings of server named queues, got", defs.Bindings)
+	}
+
+	if serverNamed.Name != "amq.gen-123" {
+		t.Error("dump should not touch queue names")
+	}
+}
+
+func TestClient_Definitions_channelDeclaration(t *testing.T) {
+	c := NewClient()
+
+	c.Declare([]Declaration{
+		DeclareQueue(&Queue{Name: "q1"}),
+		func(d Declarer) error {
+			d.QueueDeclare("q2", false, false, false, false, nil)
+			return d.(*amqp.Channel).ExchangeBind("ex1", "key", "ex2", false, nil)
+		},
+	})
+
+	defs := c.Definitions()
+
+	if len(defs.Queues) != 1 || defs.Queues[0].Name != "q1" {
+		t.Error("should leave out declarations needing a channel, got", defs.Queues)
+	}
+}
+
+func TestDefinitions_WriteTo(t *testing.T) {
+	defs := &Definitions{
+		Queues: []QueueDefinition{{Name: "b"}, {Name: "a"}},
+	}
+	defs.Sort()
+
+	var buf bytes.Buffer
+	if _, err := defs.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+
+	back, err := ReadDefinitions(&buf, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(back.Queues) != 2 || back.Queues[0].Name != "a" {
+		t.Error("should write sorted definitions back, got", back.Queues)
+	}
+}
+
+type testTopologyDeclarer struct {
+	queueDeclare    func(name string, args amqp.Table) (amqp.Queue, error)
+	exchangeDeclare func(name, kind string) error
+	queueBind       func(name, key, exchange string) error
+}
+
+func (td *testTopologyDeclarer) QueueDeclare(name string, durable, autoDelete,
+	exclusive, noWait bool, args amqp.Table) (amqp.Queue, error) {
+	return td.queueDeclare(name, args)
+}
+
+func (td *testTopologyDeclarer) ExchangeDeclare(name, kind string, durable,
+	autoDelete, internal, noWait bool, args amqp.Table) error {
+	return td.exchangeDeclare(name, kind)
+}
+
+func (td *testTopologyDeclarer) QueueBind(name, key, exchange string,
+	noWait bool, args amqp.Table) error {
+	return td.queueBind(name, key, exchange)
+}
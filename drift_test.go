@@ -0,0 +1,115 @@
+package cony
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func newTestManagementAPI(t *testing.T) *httptest.Server {
+	resources := map[string]string{
+		"/api/queues/%2F": `[
+			{"name": "q1", "vhost": "/", "durable": true, "auto_delete": false,
+			 "arguments": {"x-message-ttl": 1000}, "messages": 10},
+			{"name": "q2", "vhost": "/", "durable": false, "auto_delete": false,
+			 "arguments": {}},
+			{"name": "other", "vhost": "/", "durable": true, "auto_delete": false,
+			 "arguments": {}}
+		]`,
+		"/api/exchanges/%2F": `[
+			{"name": "", "vhost": "/", "type": "direct", "durable": true},
+			{"name": "ex1", "vhost": "/", "type": "fanout", "durable": true,
+			 "auto_delete": false, "internal": false, "arguments": {}}
+		]`,
+		"/api/bindings/%2F": `[
+			{"source": "", "vhost": "/", "destination": "q1",
+			 "destination_type": "queue", "routing_key": "q1", "arguments": {}},
+			{"source": "ex1", "vhost": "/", "destination": "q1",
+			 "destination_type": "queue", "routing_key": "k1", "arguments": {}}
+		]`,
+	}
+
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if u, p, _ := r.BasicAuth(); u != "guest" || p != "guest" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		body, ok := resources[r.URL.EscapedPath()]
+		if !ok {
+			t.Error("unexpected request", r.URL.EscapedPath())
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		fmt.Fprint(w, body)
+	}))
+}
+
+func TestDriftChecker_Check(t *testing.T) {
+	srv := newTestManagementAPI(t)
+	defer srv.Close()
+
+	q1 := &Queue{Name: "q1", Durable: true, Args: amqp.Table{"x-message-ttl": int32(1000)}}
+	q2 := &Queue{Name: "q2", Durable: true}
+	q3 := &Queue{Name: "q3"}
+	ex1 := Exchange{Name: "ex1", Kind: "topic", Durable: true}
+
+	c := NewClient()
+	c.Declare([]Declaration{
+		DeclareQueue(q1),
+		DeclareQueue(q2),
+		DeclareQueue(q3),
+		DeclareExchange(ex1),
+		DeclareBinding(Binding{Queue: q1, Exchange: ex1, Key: "k1"}),
+		DeclareBinding(Binding{Queue: q1, Exchange: ex1, Key: "k2"}),
+	})
+
+	dc := NewDriftChecker("http://guest:guest@" + srv.Listener.Addr().String() + "/")
+	drifts, err := dc.Check(context.Background(), c)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Drift{
+		{Kind: "queue", Name: "q2", Field: "durable", Expected: true, Actual: false},
+		{Kind: "queue", Name: "q3", Field: "missing"},
+		{Kind: "exchange", Name: "ex1", Field: "type", Expected: "topic", Actual: "fanout"},
+		{Kind: "binding", Name: "ex1->q1:k2", Field: "missing"},
+	}
+
+	if len(drifts) != len(expected) {
+		t.Fatalf("expected %d drifts, got %v", len(expected), drifts)
+	}
+
+	for i := range expected {
+		if drifts[i] != expected[i] {
+			t.Errorf("drift %d should be %v, got %v", i, expected[i], drifts[i])
+		}
+	}
+}
+
+func TestDriftChecker_Live_error(t *testing.T) {
+	srv := newTestManagementAPI(t)
+	defer srv.Close()
+
+	dc := NewDriftChecker(srv.URL)
+	if _, err := dc.Live(context.Background()); err == nil {
+		t.Error("should report non 200 responses")
+	}
+}
+
+func TestDrift_String(t *testing.T) {
+	d := Drift{Kind: "queue", Name: "q1", Field: "durable", Expected: true, Actual: false}
+	if d.String() != `queue "q1": durable is false, declared true` {
+		t.Error("unexpected string", d.String())
+	}
+
+	d = Drift{Kind: "queue", Name: "q1", Field: "missing"}
+	if d.String() != `queue "q1" is missing` {
+		t.Error("unexpected string", d.String())
+	}
+}
@@ -5,7 +5,7 @@ import (
 	"fmt"
 
 	"github.com/assembla/cony"
-	"github.com/streadway/amqp"
+	amqp "github.com/rabbitmq/amqp091-go"
 	"time"
 )
 
@@ -0,0 +1,152 @@
+package cony
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrBlocked is returned by Publisher with BlockedFail policy while the
+// connection is blocked by the server
+var ErrBlocked = errors.New("Connection is blocked")
+
+// BlockedPolicy defines what Publisher does while its connection is blocked
+// by the server (resource alarm, see (*Client).Blocking())
+type BlockedPolicy int
+
+const (
+	// BlockedIgnore publishes anyway, messages pile up in TCP buffers. This
+	// is the default.
+	BlockedIgnore BlockedPolicy = iota
+	// BlockedFail returns ErrBlocked immediately
+	BlockedFail
+	// BlockedWait waits until connection is unblocked, see
+	// (*Publisher).PublishWithContext() to limit the wait
+	BlockedWait
+	// BlockedDivert hands publishing to the Outbox, see DivertTo()
+	BlockedDivert
+)
+
+// Outbox stores publishings which could not be sent right away
+type Outbox interface {
+	Store(exchange, key string, pub amqp.Publishing) error
+}
+
+// flow tracks blocked state of a connection
+type flow struct {
+	blocked   bool
+	reason    string
+	unblocked chan struct{} // closed once connection is unblocked
+	l         sync.Mutex
+}
+
+func (f *flow) set(b amqp.Blocking) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	if b.Active == f.blocked {
+		f.reason = b.Reason
+		return
+	}
+
+	f.blocked = b.Active
+	f.reason = b.Reason
+	if b.Active {
+		f.unblocked = make(chan struct{})
+	} else {
+		close(f.unblocked)
+	}
+}
+
+// reset is called for a new connection, which is not blocked
+func (f *flow) reset() {
+	f.set(amqp.Blocking{Active: false})
+}
+
+func (f *flow) state() (bool, string) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.blocked, f.reason
+}
+
+// wait waits until connection is unblocked or ctx is done
+func (f *flow) wait(ctx context.Context) error {
+	f.l.Lock()
+	blocked, unblocked := f.blocked, f.unblocked
+	f.l.Unlock()
+
+	if !blocked {
+		return nil
+	}
+
+	select {
+	case <-unblocked:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// IsBlocked tells whether publishing connection is blocked by the server
+func (c *Client) IsBlocked() bool {
+	blocked, _ := c.publishingLink().flow.state()
+	return blocked
+}
+
+// BlockedReason returns the reason server gave for blocking publishing
+// connection, empty if it's not blocked
+func (c *Client) BlockedReason() string {
+	blocked, reason := c.publishingLink().flow.state()
+	if !blocked {
+		return ""
+	}
+	return reason
+}
+
+// OnBlocked is a Publisher's functional option, defines what to do while the
+// connection is blocked. Default is BlockedIgnore.
+func OnBlocked(policy BlockedPolicy) PublisherOpt {
+	return func(p *Publisher) {
+		p.onBlocked = policy
+	}
+}
+
+// DivertTo is a Publisher's functional option, publishings are stored in the
+// Outbox while the connection is blocked
+func DivertTo(o Outbox) PublisherOpt {
+	return func(p *Publisher) {
+		p.onBlocked = BlockedDivert
+		p.outbox = o
+	}
+}
+
+// checkBlocked applies the blocked policy. It returns true if publishing was
+// handled (diverted or failed) and should not be sent.
+func (p *Publisher) checkBlocked(ctx context.Context, pub amqp.Publishing, key string) (bool, error) {
+	p.m.Lock()
+	f := p.flow
+	p.m.Unlock()
+
+	if f == nil || p.onBlocked == BlockedIgnore {
+		return false, nil
+	}
+
+	if blocked, _ := f.state(); !blocked {
+		return false, nil
+	}
+
+	switch p.onBlocked {
+	case BlockedFail:
+		return true, ErrBlocked
+	case BlockedDivert:
+		if p.outbox == nil {
+			return true, ErrBlocked
+		}
+		return true, p.outbox.Store(p.exchange, key, pub)
+	}
+
+	// BlockedWait
+	return false, f.wait(ctx)
+}
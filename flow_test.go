@@ -0,0 +1,105 @@
+package cony
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type testOutbox struct {
+	stored []string
+}
+
+func (o *testOutbox) Store(exchange, key string, pub amqp.Publishing) error {
+	o.stored = append(o.stored, exchange+":"+key)
+	return nil
+}
+
+func TestClient_IsBlocked(t *testing.T) {
+	c := NewClient()
+
+	if c.IsBlocked() || c.BlockedReason() != "" {
+		t.Error("should not be blocked initially")
+	}
+
+	c.flow.set(amqp.Blocking{Active: true, Reason: "low on memory"})
+
+	if !c.IsBlocked() || c.BlockedReason() != "low on memory" {
+		t.Error("should be blocked with reason")
+	}
+
+	c.flow.reset()
+
+	if c.IsBlocked() || c.BlockedReason() != "" {
+		t.Error("should be unblocked")
+	}
+
+	sep := NewClient(SeparateConnections())
+	sep.flow.set(amqp.Blocking{Active: true})
+
+	if sep.IsBlocked() {
+		t.Error("should report publishing connection state")
+	}
+}
+
+func TestPublisher_OnBlocked_fail(t *testing.T) {
+	c := NewClient()
+	p := NewPublisher("ex", "key", OnBlocked(BlockedFail))
+	c.Publish(p)
+
+	c.flow.set(amqp.Blocking{Active: true})
+
+	if err := p.Publish(amqp.Publishing{}); err != ErrBlocked {
+		t.Error("should fail fast, got", err)
+	}
+}
+
+func TestPublisher_OnBlocked_divert(t *testing.T) {
+	c := NewClient()
+	o := &testOutbox{}
+	p := NewPublisher("ex", "key", DivertTo(o))
+	c.Publish(p)
+
+	c.flow.set(amqp.Blocking{Active: true})
+
+	if err := p.Publish(amqp.Publishing{}); err != nil {
+		t.Error("should divert without error, got", err)
+	}
+
+	if len(o.stored) != 1 || o.stored[0] != "ex:key" {
+		t.Error("should store publishing in outbox, got", o.stored)
+	}
+}
+
+func TestPublisher_OnBlocked_wait(t *testing.T) {
+	c := NewClient()
+	p := NewPublisher("ex", "key", OnBlocked(BlockedWait))
+	c.Publish(p)
+
+	c.flow.set(amqp.Blocking{Active: true})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	if err := p.PublishWithContext(ctx, amqp.Publishing{}, "key"); err != context.DeadlineExceeded {
+		t.Error("should wait until deadline, got", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- p.PublishWithContext(context.Background(), amqp.Publishing{}, "key")
+	}()
+
+	c.flow.reset()
+
+	// unblocked publishing waits for the connection, serve it
+	envelop := <-p.pubChan
+	<-envelop.pub
+	close(envelop.err)
+
+	if err := <-done; err != nil {
+		t.Error("should publish once unblocked, got", err)
+	}
+}
@@ -0,0 +1,5 @@
+module github.com/assembla/cony
+
+go 1.17
+
+require github.com/rabbitmq/amqp091-go v1.9.0
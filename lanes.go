@@ -0,0 +1,204 @@
+package cony
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// KeyFunc extracts ordering key of a message, messages with the same key are
+// processed one by one in the order they were delivered
+type KeyFunc func(amqp.Delivery) string
+
+// RoutingKeyOrder orders messages by routing key
+func RoutingKeyOrder() KeyFunc {
+	return func(d amqp.Delivery) string {
+		return d.RoutingKey
+	}
+}
+
+// HeaderOrder orders messages by header value, messages without the header
+// share an empty key
+func HeaderOrder(header string) KeyFunc {
+	return func(d amqp.Delivery) string {
+		if v, ok := d.Headers[header]; ok {
+			return fmt.Sprint(v)
+		}
+		return ""
+	}
+}
+
+// DeliveryHandler processes a message. It's acknowledged if handler returns
+// nil, otherwise it's rejected and requeued.
+type DeliveryHandler func(amqp.Delivery) error
+
+// LaneConsumer processes messages of a Consumer concurrently in a number of
+// serial lanes. Messages are assigned to lanes by hash of their key, so
+// messages with the same key are processed in order.
+type LaneConsumer struct {
+	*Consumer
+	lanes int
+	key   KeyFunc
+}
+
+// NewLaneConsumer creates LaneConsumer of queue q with n lanes. Prefetch is
+// 10 messages per lane by default: slow message holds back acknowledgement of
+// messages delivered after it, so prefetch should be several times the
+// number of lanes.
+func NewLaneConsumer(q *Queue, n int, key KeyFunc, opts ...ConsumerOpt) *LaneConsumer {
+	if n < 1 {
+		n = 1
+	}
+
+	opts = append([]ConsumerOpt{Qos(n * 10)}, opts...)
+
+	return &LaneConsumer{
+		Consumer: NewConsumer(q, opts...),
+		lanes:    n,
+		key:      key,
+	}
+}
+
+// Handle processes deliveries with h until ctx is done or consumer is
+// canceled, then waits for messages already assigned to lanes. Processed
+// messages are acknowledged with multiple flag up to the first message which
+// is still being processed, so acks never go past an unprocessed message.
+// Failed messages are rejected one by one and requeued. Ack errors are
+// reported to Errors().
+func (lc *LaneConsumer) Handle(ctx context.Context, h DeliveryHandler) error {
+	var (
+		wg    sync.WaitGroup
+		acks  = newAckTrackers(lc.autoAck, lc.reportErr)
+		lanes = make([]chan amqp.Delivery, lc.lanes)
+	)
+
+	for i := range lanes {
+		lanes[i] = make(chan amqp.Delivery, 1)
+		wg.Add(1)
+		go func(lane chan amqp.Delivery) {
+			defer wg.Done()
+			for d := range lane {
+				err := h(d)
+				acks.done(d, err == nil)
+				lc.reportErr(err)
+			}
+		}(lanes[i])
+	}
+
+	defer func() {
+		for _, lane := range lanes {
+			close(lane)
+		}
+		wg.Wait()
+	}()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d, ok := <-lc.Deliveries():
+			if !ok {
+				return nil
+			}
+
+			acks.add(d)
+
+			lane := lanes[hashKey(lc.key(d))%uint32(len(lanes))]
+
+			select {
+			case lane <- d:
+			case <-ctx.Done():
+				// not processed, server redelivers it once channel is closed
+				return ctx.Err()
+			}
+		}
+	}
+}
+
+func hashKey(key string) uint32 {
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return hash.Sum32()
+}
+
+// ackTracker acknowledges processed deliveries of a channel in order of
+// delivery tags
+type ackTracker struct {
+	pending  []uint64 // delivery tags in order of delivery
+	finished map[uint64]amqp.Delivery
+}
+
+// ackTrackers keeps ackTracker per channel, delivery tags are per channel
+type ackTrackers struct {
+	autoAck  bool
+	report   func(error) bool
+	channels map[<-chan struct{}]*ackTracker
+	l        sync.Mutex
+}
+
+func newAckTrackers(autoAck bool, report func(error) bool) *ackTrackers {
+	return &ackTrackers{
+		autoAck:  autoAck,
+		report:   report,
+		channels: make(map[<-chan struct{}]*ackTracker),
+	}
+}
+
+// add registers delivery before it's processed
+func (a *ackTrackers) add(d amqp.Delivery) {
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	gone := channelGone(d)
+	t := a.channels[gone]
+	if t == nil {
+		t = &ackTracker{finished: make(map[uint64]amqp.Delivery)}
+		a.channels[gone] = t
+	}
+	t.pending = append(t.pending, d.DeliveryTag)
+}
+
+// done settles processed delivery: failed one is rejected right away,
+// successful ones are acknowledged once all deliveries before them are
+// settled
+func (a *ackTrackers) done(d amqp.Delivery, ok bool) {
+	if !ok && !a.autoAck && d.Acknowledger != nil {
+		a.report(d.Nack(false, true))
+	}
+
+	a.l.Lock()
+	defer a.l.Unlock()
+
+	gone := channelGone(d)
+	t := a.channels[gone]
+	if ok {
+		t.finished[d.DeliveryTag] = d
+	} else {
+		// settled, but must not be acknowledged with multiple flag
+		t.finished[d.DeliveryTag] = amqp.Delivery{}
+	}
+
+	var last amqp.Delivery
+	for len(t.pending) > 0 {
+		settled, ok := t.finished[t.pending[0]]
+		if !ok {
+			break
+		}
+		delete(t.finished, t.pending[0])
+		t.pending = t.pending[1:]
+		if settled.Acknowledger != nil {
+			last = settled
+		}
+	}
+
+	if len(t.pending) == 0 {
+		delete(a.channels, gone)
+	}
+
+	if last.Acknowledger != nil && !a.autoAck {
+		a.report(last.Ack(true))
+	}
+}
@@ -0,0 +1,133 @@
+package cony
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestLaneConsumer_order(t *testing.T) {
+	var (
+		l         sync.Mutex
+		processed = make(map[string][]int)
+		ack       = &testAcknowledger{}
+	)
+
+	lc := NewLaneConsumer(&Queue{}, 4, HeaderOrder("entity"))
+	if lc.qos != 40 {
+		t.Error("should set prefetch per lane, got", lc.qos)
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- lc.Handle(context.Background(), func(d amqp.Delivery) error {
+			l.Lock()
+			defer l.Unlock()
+			key := d.Headers["entity"].(string)
+			processed[key] = append(processed[key], int(d.DeliveryTag))
+			return nil
+		})
+	}()
+
+	for i := 1; i <= 100; i++ {
+		lc.deliveries <- amqp.Delivery{
+			Acknowledger: ack,
+			DeliveryTag:  uint64(i),
+			Headers:      amqp.Table{"entity": fmt.Sprint(i % 7)},
+		}
+	}
+
+	lc.Cancel()
+	if err := <-done; err != nil {
+		t.Error("should return nil once canceled, got", err)
+	}
+
+	var total int
+	for key, tags := range processed {
+		total += len(tags)
+		for i := 1; i < len(tags); i++ {
+			if tags[i] < tags[i-1] {
+				t.Error("should process messages of the same key in order", key, tags)
+				break
+			}
+		}
+	}
+
+	if total != 100 {
+		t.Error("should process all messages, processed", total)
+	}
+
+	if last := ack.acked[len(ack.acked)-1]; last != 100 {
+		t.Error("should acknowledge all messages eventually, last ack", last)
+	}
+}
+
+func TestLaneConsumer_ack(t *testing.T) {
+	var (
+		ack     = &testAcknowledger{}
+		release = make(chan bool)
+		handled = make(chan uint64, 3)
+		failErr = errors.New("fail")
+	)
+
+	lc := NewLaneConsumer(&Queue{}, 2, RoutingKeyOrder())
+
+	done := make(chan error)
+	go func() {
+		done <- lc.Handle(context.Background(), func(d amqp.Delivery) error {
+			defer func() { handled <- d.DeliveryTag }()
+
+			switch d.DeliveryTag {
+			case 1:
+				<-release
+			case 3:
+				return failErr
+			}
+			return nil
+		})
+	}()
+
+	// find keys hashed to different lanes
+	lane := func(key string) uint32 {
+		return hashKey(key) % 2
+	}
+	slow, fast := "a", "b"
+	for lane(fast) == lane(slow) {
+		fast += "b"
+	}
+
+	lc.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 1, RoutingKey: slow}
+	lc.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 2, RoutingKey: fast}
+	lc.deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: 3, RoutingKey: fast}
+
+	<-handled
+	<-handled
+
+	// reported once failed message is settled
+	if err := <-lc.Errors(); err != failErr {
+		t.Error("should report handler error, got", err)
+	}
+
+	ack.l.Lock()
+	if len(ack.acked) != 0 {
+		t.Error("should not ack past unprocessed message, acked", ack.acked)
+	}
+	if len(ack.nacked) != 1 || ack.nacked[0] != 3 {
+		t.Error("should reject failed message, got", ack.nacked)
+	}
+	ack.l.Unlock()
+
+	close(release)
+	<-handled
+
+	lc.Cancel()
+	<-done
+
+	if len(ack.acked) != 1 || ack.acked[0] != 2 {
+		t.Error("should ack up to the last processed message, got", ack.acked)
+	}
+}
@@ -0,0 +1,214 @@
+package cony
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// ErrDeliveryLimit is recorded in quarantined message headers when it was
+// delivered more times than allowed, without handler reporting an error
+// (e.g. the process crashed while handling it)
+var ErrDeliveryLimit = errors.New("Delivery limit exceeded")
+
+// PoisonGuard quarantines messages which keep failing: once a message was
+// delivered maxDeliveries times and handler still fails, it's published to
+// the quarantine Publisher with error metadata in headers, and the original
+// is acknowledged instead of being requeued forever.
+//
+// Deliveries are counted by x-delivery-count header (quorum queues), or
+// locally by MessageId. Messages without both are counted by Redelivered
+// flag only, i.e. they are quarantined on second failure at most. Local
+// counts are kept for the last poisonTracked messages: a message requeued
+// to another consumer may never come back.
+//
+// Quarantine publishing waits for connection no longer than quarantineTimeout,
+// message is requeued otherwise.
+type PoisonGuard struct {
+	pub           *Publisher
+	maxDeliveries int
+	timeout       time.Duration
+	counts        map[string]*list.Element // deliveries by MessageId
+	recent        *list.List               // *poisonCount, most recent first
+	l             sync.Mutex
+}
+
+const (
+	poisonTracked     = 10000
+	quarantineTimeout = 5 * time.Second
+)
+
+type poisonCount struct {
+	id string
+	n  int
+}
+
+// NewPoisonGuard creates PoisonGuard publishing poison messages with pub.
+// Publisher's routing key is used, or the original one if it's empty.
+func NewPoisonGuard(pub *Publisher, maxDeliveries int) *PoisonGuard {
+	if maxDeliveries < 1 {
+		maxDeliveries = 1
+	}
+
+	return &PoisonGuard{
+		pub:           pub,
+		maxDeliveries: maxDeliveries,
+		timeout:       quarantineTimeout,
+		counts:        make(map[string]*list.Element),
+		recent:        list.New(),
+	}
+}
+
+// Wrap returns handler which runs h and quarantines poison messages. It
+// returns nil once message is quarantined, so the original is acknowledged,
+// error of h if message could still be retried, or error of quarantine
+// publishing. Panics of h are recovered and treated as errors.
+func (g *PoisonGuard) Wrap(h DeliveryHandler) DeliveryHandler {
+	return func(d amqp.Delivery) error {
+		n := g.deliveries(d)
+
+		if n > g.maxDeliveries {
+			return g.quarantine(d, n, ErrDeliveryLimit)
+		}
+
+		err := safeHandle(h, d)
+		if err == nil {
+			g.forget(d)
+			return nil
+		}
+
+		if n < g.maxDeliveries {
+			return err
+		}
+		return g.quarantine(d, n, err)
+	}
+}
+
+// Handle runs h with Wrap() and acknowledges d: acks it if it was handled or
+// quarantined, nacks and requeues it otherwise. It's for consumers which
+// handle deliveries of Consumer themselves.
+func (g *PoisonGuard) Handle(d amqp.Delivery, h DeliveryHandler) error {
+	if err := g.Wrap(h)(d); err != nil {
+		if nackErr := d.Nack(false, true); nackErr != nil {
+			return nackErr
+		}
+		return err
+	}
+	return d.Ack(false)
+}
+
+// deliveries returns how many times d was delivered, including this time
+func (g *PoisonGuard) deliveries(d amqp.Delivery) int {
+	switch v := d.Headers["x-delivery-count"].(type) {
+	case int64:
+		return int(v) + 1
+	case int32:
+		return int(v) + 1
+	case int:
+		return v + 1
+	}
+
+	if d.MessageId != "" {
+		g.l.Lock()
+		defer g.l.Unlock()
+
+		e, ok := g.counts[d.MessageId]
+		if ok {
+			g.recent.MoveToFront(e)
+		} else {
+			// first delivery seen here may be a redelivery of another consumer
+			c := &poisonCount{id: d.MessageId}
+			if d.Redelivered {
+				c.n = 1
+			}
+			e = g.recent.PushFront(c)
+			g.counts[d.MessageId] = e
+
+			if g.recent.Len() > poisonTracked {
+				oldest := g.recent.Back()
+				g.recent.Remove(oldest)
+				delete(g.counts, oldest.Value.(*poisonCount).id)
+			}
+		}
+
+		c := e.Value.(*poisonCount)
+		c.n++
+		return c.n
+	}
+
+	if d.Redelivered {
+		return g.maxDeliveries
+	}
+	return 1
+}
+
+func (g *PoisonGuard) forget(d amqp.Delivery) {
+	if d.MessageId == "" {
+		return
+	}
+
+	g.l.Lock()
+	defer g.l.Unlock()
+	if e, ok := g.counts[d.MessageId]; ok {
+		g.recent.Remove(e)
+		delete(g.counts, d.MessageId)
+	}
+}
+
+// quarantine publishes d with error metadata
+func (g *PoisonGuard) quarantine(d amqp.Delivery, n int, cause error) error {
+	headers := amqp.Table{}
+	for k, v := range d.Headers {
+		headers[k] = v
+	}
+	headers["x-quarantine-error"] = cause.Error()
+	headers["x-quarantine-deliveries"] = int32(n)
+	headers["x-quarantine-exchange"] = d.Exchange
+	headers["x-quarantine-routing-key"] = d.RoutingKey
+	headers["x-quarantine-consumer-tag"] = d.ConsumerTag
+	headers["x-quarantine-time"] = time.Now().UTC()
+
+	key := g.pub.key
+	if key == "" {
+		key = d.RoutingKey
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), g.timeout)
+	defer cancel()
+
+	err := g.pub.PublishWithContext(ctx, amqp.Publishing{
+		Headers:         headers,
+		ContentType:     d.ContentType,
+		ContentEncoding: d.ContentEncoding,
+		DeliveryMode:    d.DeliveryMode,
+		Priority:        d.Priority,
+		CorrelationId:   d.CorrelationId,
+		ReplyTo:         d.ReplyTo,
+		MessageId:       d.MessageId,
+		Timestamp:       d.Timestamp,
+		Type:            d.Type,
+		AppId:           d.AppId,
+		Body:            d.Body,
+	}, key)
+	if err != nil {
+		return err
+	}
+
+	g.forget(d)
+	return nil
+}
+
+// safeHandle runs h, recovering its panic as error
+func safeHandle(h DeliveryHandler, d amqp.Delivery) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return h(d)
+}
@@ -0,0 +1,196 @@
+package cony
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type quarantined struct {
+	key string
+	msg amqp.Publishing
+}
+
+// serveQuarantine serves publisher's publishings
+func serveQuarantine(p *Publisher) chan quarantined {
+	published := make(chan quarantined, 10)
+
+	go func() {
+		for {
+			select {
+			case <-p.stop:
+				return
+			case envelop := <-p.pubChan:
+				published <- quarantined{key: envelop.key, msg: <-envelop.pub}
+				close(envelop.err)
+			}
+		}
+	}()
+
+	return published
+}
+
+func TestPoisonGuard_MessageId(t *testing.T) {
+	p := NewPublisher("quarantine", "")
+	defer p.Cancel()
+	published := serveQuarantine(p)
+
+	g := NewPoisonGuard(p, 3)
+	handleErr := errors.New("handle")
+	h := g.Wrap(func(amqp.Delivery) error {
+		return handleErr
+	})
+
+	d := amqp.Delivery{
+		MessageId:  "m1",
+		RoutingKey: "orders",
+		Exchange:   "ex",
+		Headers:    amqp.Table{"tenant": "t1"},
+		Body:       []byte("poison"),
+	}
+
+	for i := 1; i < 3; i++ {
+		if err := h(d); err != handleErr {
+			t.Errorf("delivery %d should be retried, got %v", i, err)
+		}
+		d.Redelivered = true
+	}
+
+	if err := h(d); err != nil {
+		t.Error("should quarantine on the last delivery, got", err)
+	}
+
+	q := <-published
+	if q.key != "orders" || string(q.msg.Body) != "poison" || q.msg.MessageId != "m1" {
+		t.Errorf("should publish original message, got %+v", q)
+	}
+
+	headers := q.msg.Headers
+	if headers["x-quarantine-error"] != "handle" || headers["x-quarantine-deliveries"] != int32(3) ||
+		headers["x-quarantine-exchange"] != "ex" || headers["tenant"] != "t1" {
+		t.Error("should add error metadata to headers, got", headers)
+	}
+
+	if len(g.counts) != 0 {
+		t.Error("should forget quarantined message")
+	}
+}
+
+func TestPoisonGuard_deliveryCount(t *testing.T) {
+	p := NewPublisher("quarantine", "poison")
+	defer p.Cancel()
+	published := serveQuarantine(p)
+
+	var called bool
+	g := NewPoisonGuard(p, 5)
+	h := g.Wrap(func(amqp.Delivery) error {
+		called = true
+		return nil
+	})
+
+	// quorum queue counts previous deliveries, e.g. process crashed
+	d := amqp.Delivery{Headers: amqp.Table{"x-delivery-count": int64(5)}, Redelivered: true}
+	if err := h(d); err != nil {
+		t.Fatal(err)
+	}
+
+	if called {
+		t.Error("should not handle message over the limit")
+	}
+
+	q := <-published
+	if q.key != "poison" || q.msg.Headers["x-quarantine-error"] != ErrDeliveryLimit.Error() {
+		t.Errorf("should quarantine with publisher key and limit error, got %+v", q)
+	}
+}
+
+func TestPoisonGuard_Handle(t *testing.T) {
+	p := NewPublisher("quarantine", "")
+	defer p.Cancel()
+	serveQuarantine(p)
+
+	g := NewPoisonGuard(p, 2)
+	ack := &testAcknowledger{}
+	panicky := func(amqp.Delivery) error {
+		panic("boom")
+	}
+
+	d := amqp.Delivery{Acknowledger: ack, DeliveryTag: 1}
+	if err := g.Handle(d, panicky); err == nil || err.Error() != "panic: boom" {
+		t.Error("should recover handler panic, got", err)
+	}
+
+	if len(ack.nacked) != 1 {
+		t.Error("should requeue failed message")
+	}
+
+	d.Redelivered = true
+	if err := g.Handle(d, panicky); err != nil {
+		t.Error("should quarantine redelivered message, got", err)
+	}
+
+	if len(ack.acked) != 1 {
+		t.Error("should ack quarantined message")
+	}
+
+	if err := g.Handle(amqp.Delivery{Acknowledger: ack}, func(amqp.Delivery) error { return nil }); err != nil {
+		t.Error("should ack handled message, got", err)
+	}
+}
+
+func TestPoisonGuard_tracked(t *testing.T) {
+	g := NewPoisonGuard(NewPublisher("quarantine", ""), 3)
+	h := g.Wrap(func(amqp.Delivery) error {
+		return errors.New("handle")
+	})
+
+	for i := 0; i <= poisonTracked; i++ {
+		h(amqp.Delivery{MessageId: fmt.Sprint(i)})
+	}
+
+	if len(g.counts) != poisonTracked || g.recent.Len() != poisonTracked {
+		t.Error("should keep counts of last messages only, got", len(g.counts))
+	}
+
+	if _, ok := g.counts["0"]; ok {
+		t.Error("should forget the oldest message")
+	}
+
+	if n := g.deliveries(amqp.Delivery{MessageId: "1"}); n != 2 {
+		t.Error("should count recent message, got", n)
+	}
+}
+
+func TestPoisonGuard_quarantineTimeout(t *testing.T) {
+	p := NewPublisher("quarantine", "")
+	defer p.Cancel()
+
+	g := NewPoisonGuard(p, 1)
+	g.timeout = 10 * time.Millisecond
+	handleErr := errors.New("handle")
+	d := amqp.Delivery{MessageId: "m1"}
+
+	done := make(chan error)
+	go func() {
+		done <- g.Wrap(func(amqp.Delivery) error {
+			return handleErr
+		})(d)
+	}()
+
+	select {
+	case err := <-done:
+		if err != context.DeadlineExceeded {
+			t.Error("should fail quarantine without connection, got", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("should not block handler waiting for connection")
+	}
+
+	if len(g.counts) != 1 {
+		t.Error("should keep count to quarantine on redelivery")
+	}
+}
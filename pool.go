@@ -0,0 +1,212 @@
+package cony
+
+import (
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// amqpChannel is implemented by *amqp.Channel
+type amqpChannel interface {
+	mqChannel
+	Declarer
+	unbinder
+}
+
+// pooledChannel is an AMQP channel owned by channelPool
+type pooledChannel struct {
+	ch     amqpChannel
+	closed chan struct{} // closed once AMQP channel is closed
+}
+
+func newPooledChannel(ch amqpChannel) *pooledChannel {
+	pc := &pooledChannel{
+		ch:     ch,
+		closed: make(chan struct{}),
+	}
+
+	errs := ch.NotifyClose(make(chan *amqp.Error, 1))
+	go func() {
+		for range errs {
+		}
+		close(pc.closed)
+	}()
+
+	return pc
+}
+
+func (pc *pooledChannel) healthy() bool {
+	select {
+	case <-pc.closed:
+		return false
+	default:
+		return true
+	}
+}
+
+// channelPool shares a limited number of channels of one connection between
+// publishers, and keeps a single channel for declarations. Channels closed by
+// the server are replaced on next use.
+type channelPool struct {
+	open  func() (amqpChannel, error)
+	size  int
+	slots []*pooledChannel
+	next  int
+	decl  *pooledChannel
+	l     sync.Mutex
+}
+
+// newChannelPool creates a pool of up to size channels for publishers. Pool
+// never exceeds channelMax negotiated with the server: one channel is left
+// for declarations and reserved ones for consumers of the connection.
+func newChannelPool(open func() (amqpChannel, error), size, channelMax, reserved int) *channelPool {
+	if limit := channelMax - 1 - reserved; channelMax > 0 && size > limit {
+		size = limit
+		if size < 1 {
+			size = 1
+		}
+	}
+
+	return &channelPool{
+		open: open,
+		size: size,
+	}
+}
+
+// get returns a lease on a shared channel. Channels are opened lazily up to
+// pool size, then handed out round robin. Pool stops growing once the
+// connection runs out of channels, e.g. consumers registered later took
+// them.
+func (p *channelPool) get() (mqChannel, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if len(p.slots) < p.size {
+		ch, err := p.open()
+		switch {
+		case err == nil:
+			pc := newPooledChannel(ch)
+			p.slots = append(p.slots, pc)
+			return newChannelLease(pc), nil
+		case err == amqp.ErrChannelMax && len(p.slots) > 0:
+			p.size = len(p.slots)
+		default:
+			return nil, err
+		}
+	}
+
+	if len(p.slots) == 0 {
+		return nil, amqp.ErrChannelMax
+	}
+
+	i := p.next % len(p.slots)
+	p.next++
+
+	if !p.slots[i].healthy() {
+		ch, err := p.open()
+		if err != nil {
+			return nil, err
+		}
+		p.slots[i] = newPooledChannel(ch)
+	}
+
+	return newChannelLease(p.slots[i]), nil
+}
+
+// declarer returns the channel used for declarations, reopening it if
+// previous declaration caused channel exception
+func (p *channelPool) declarer() (amqpChannel, error) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if p.decl == nil || !p.decl.healthy() {
+		ch, err := p.open()
+		if err != nil {
+			return nil, err
+		}
+		p.decl = newPooledChannel(ch)
+	}
+
+	return p.decl.ch, nil
+}
+
+// discard drops declarations channel ch after it failed with an AMQP error,
+// so the next declaration opens a new one without waiting for close
+// notification, which arrives asynchronously
+func (p *channelPool) discard(ch amqpChannel) {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	if p.decl != nil && p.decl.ch == ch {
+		p.decl = nil
+	}
+}
+
+// close closes all channels of the pool
+func (p *channelPool) close() {
+	p.l.Lock()
+	defer p.l.Unlock()
+
+	for _, pc := range p.slots {
+		pc.ch.Close()
+	}
+	p.slots = nil
+
+	if p.decl != nil {
+		p.decl.ch.Close()
+		p.decl = nil
+	}
+}
+
+// channelLease is a publisher's handle of a shared channel. Closing the lease
+// returns the channel to the pool, the channel itself stays open.
+type channelLease struct {
+	*pooledChannel
+	released chan struct{}
+	once     sync.Once
+}
+
+func newChannelLease(pc *pooledChannel) *channelLease {
+	return &channelLease{
+		pooledChannel: pc,
+		released:      make(chan struct{}),
+	}
+}
+
+func (l *channelLease) Close() error {
+	l.once.Do(func() {
+		close(l.released)
+	})
+	return nil
+}
+
+func (l *channelLease) Consume(queue, consumer string, autoAck, exclusive,
+	noLocal, noWait bool, args amqp.Table) (<-chan amqp.Delivery, error) {
+	return l.ch.Consume(queue, consumer, autoAck, exclusive, noLocal, noWait, args)
+}
+
+// NotifyClose closes c once the shared channel is closed, unless the lease
+// was released before
+func (l *channelLease) NotifyClose(c chan *amqp.Error) chan *amqp.Error {
+	go func() {
+		select {
+		case <-l.closed:
+			close(c)
+		case <-l.released:
+		}
+	}()
+	return c
+}
+
+func (l *channelLease) NotifyCancel(c chan string) chan string {
+	return l.ch.NotifyCancel(c)
+}
+
+func (l *channelLease) Publish(exchange, key string, mandatory, immediate bool,
+	msg amqp.Publishing) error {
+	return l.ch.Publish(exchange, key, mandatory, immediate, msg)
+}
+
+func (l *channelLease) Qos(prefetchCount, prefetchSize int, global bool) error {
+	return l.ch.Qos(prefetchCount, prefetchSize, global)
+}
@@ -0,0 +1,246 @@
+package cony
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type testPoolChannel struct {
+	mqChannelTest
+	testDeclarer
+	closeNotify chan *amqp.Error
+	closed      bool
+}
+
+func newTestPoolChannel() *testPoolChannel {
+	ch := &testPoolChannel{}
+	ch._NotifyClose = func(c chan *amqp.Error) chan *amqp.Error {
+		ch.closeNotify = c
+		return c
+	}
+	ch._Close = func() error {
+		ch.closed = true
+		return nil
+	}
+	return ch
+}
+
+func (ch *testPoolChannel) QueueUnbind(name, key, exchange string, args amqp.Table) error {
+	return nil
+}
+
+// kill imitates channel exception
+func (ch *testPoolChannel) kill() {
+	ch.closeNotify <- &amqp.Error{Code: amqp.PreconditionFailed}
+	close(ch.closeNotify)
+}
+
+func newTestPool(size, channelMax int) (*channelPool, *[]*testPoolChannel) {
+	var opened []*testPoolChannel
+
+	return newChannelPool(func() (amqpChannel, error) {
+		ch := newTestPoolChannel()
+		opened = append(opened, ch)
+		return ch, nil
+	}, size, channelMax, 0), &opened
+}
+
+func TestChannelPool_get(t *testing.T) {
+	p, opened := newTestPool(2, 0)
+
+	for i := 0; i < 4; i++ {
+		if _, err := p.get(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if len(*opened) != 2 {
+		t.Error("should open no more channels than pool size, opened", len(*opened))
+	}
+
+	l1, _ := p.get()
+	l1.Close()
+	if (*opened)[0].closed {
+		t.Error("closing lease should not close shared channel")
+	}
+}
+
+func TestChannelPool_get_unhealthy(t *testing.T) {
+	p, opened := newTestPool(1, 0)
+
+	l1, _ := p.get()
+	notify := l1.NotifyClose(make(chan *amqp.Error))
+
+	(*opened)[0].kill()
+
+	select {
+	case _, ok := <-notify:
+		if ok {
+			t.Error("lease close notification should be closed")
+		}
+	case <-time.After(100 * time.Millisecond):
+		t.Fatal("lease should be notified about closed channel")
+	}
+
+	if _, err := p.get(); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(*opened) != 2 {
+		t.Error("should replace closed channel")
+	}
+}
+
+func TestChannelPool_channelMax(t *testing.T) {
+	p, _ := newTestPool(10, 3)
+
+	if p.size != 2 {
+		t.Error("pool size should respect ChannelMax, got", p.size)
+	}
+
+	p, _ = newTestPool(0, 0)
+	if _, err := p.get(); err != amqp.ErrChannelMax {
+		t.Error("empty pool should return ErrChannelMax, got", err)
+	}
+
+	p = newChannelPool(nil, 10, 8, 5)
+	if p.size != 2 {
+		t.Error("pool size should leave channels for consumers, got", p.size)
+	}
+
+	p = newChannelPool(nil, 10, 4, 5)
+	if p.size != 1 {
+		t.Error("pool should keep at least one channel, got", p.size)
+	}
+}
+
+func TestChannelPool_get_channelMax(t *testing.T) {
+	opened := 0
+	p := newChannelPool(func() (amqpChannel, error) {
+		if opened == 2 {
+			// the rest was taken by consumers
+			return nil, amqp.ErrChannelMax
+		}
+		opened++
+		return newTestPoolChannel(), nil
+	}, 5, 0, 0)
+
+	for i := 0; i < 5; i++ {
+		if _, err := p.get(); err != nil {
+			t.Fatal("should share opened channels, got", err)
+		}
+	}
+
+	if p.size != 2 {
+		t.Error("pool should stop growing, size", p.size)
+	}
+}
+
+func TestChannelPool_declarer(t *testing.T) {
+	p, opened := newTestPool(0, 0)
+
+	ch1, _ := p.declarer()
+	ch2, _ := p.declarer()
+
+	if ch1 != ch2 || len(*opened) != 1 {
+		t.Error("declarations channel should be reused")
+	}
+
+	(*opened)[0].kill()
+	<-p.decl.closed
+
+	p.declarer()
+	if len(*opened) != 2 {
+		t.Error("should reopen declarations channel after exception")
+	}
+
+	p.close()
+	if !(*opened)[1].closed {
+		t.Error("should close declarations channel")
+	}
+}
+
+func TestChannelPool_discard(t *testing.T) {
+	p, opened := newTestPool(0, 0)
+
+	ch1, _ := p.declarer()
+	// close notification is not delivered yet
+	p.discard(ch1)
+
+	ch2, _ := p.declarer()
+	if ch1 == ch2 || len(*opened) != 2 {
+		t.Error("should reopen discarded declarations channel")
+	}
+
+	p.discard(ch1)
+	if ch3, _ := p.declarer(); ch3 != ch2 {
+		t.Error("should not discard channel which replaced stale one")
+	}
+}
+
+func TestClient_withChannel_closed(t *testing.T) {
+	c := NewClient()
+	p, opened := newTestPool(0, 0)
+	c.conn.Store(&amqp.Connection{})
+	c.pool.Store(p)
+
+	calls := 0
+	err := c.withChannel(func(ch amqpChannel) error {
+		calls++
+		if calls == 1 {
+			// closed by previous failed declaration
+			return amqp.ErrClosed
+		}
+		return nil
+	})
+
+	if err != nil || calls != 2 || len(*opened) != 2 {
+		t.Error("should retry once on a fresh channel, got", err, calls, len(*opened))
+	}
+
+	calls = 0
+	failed := &amqp.Error{Code: amqp.PreconditionFailed}
+	err = c.withChannel(func(ch amqpChannel) error {
+		calls++
+		return failed
+	})
+
+	if err != failed || calls != 1 {
+		t.Error("should not retry declaration which failed, got", err, calls)
+	}
+
+	c.withChannel(func(ch amqpChannel) error { return nil })
+	if len(*opened) != 3 {
+		t.Error("should not reuse channel after channel exception")
+	}
+}
+
+func TestChannelPool_open_error(t *testing.T) {
+	openErr := errors.New("open")
+	p := newChannelPool(func() (amqpChannel, error) {
+		return nil, openErr
+	}, 1, 0, 0)
+
+	if _, err := p.get(); err != openErr {
+		t.Error("should return open error, got", err)
+	}
+
+	if _, err := p.declarer(); err != openErr {
+		t.Error("should return open error, got", err)
+	}
+}
+
+func TestChannelPoolSize(t *testing.T) {
+	c := NewClient(ChannelPoolSize(5))
+
+	if c.poolSize != 5 {
+		t.Error("should set pool size")
+	}
+
+	if _, err := c.publisherChannel(); err != ErrNoConnection {
+		t.Error("should report no connection, got", err)
+	}
+}
@@ -0,0 +1,184 @@
+package cony
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// PrefetchEvent is a prefetch change made by PrefetchController
+type PrefetchEvent struct {
+	From    int
+	To      int
+	Latency time.Duration // average handler latency over the window
+	AckRate float64       // messages processed per second over the window
+	Err     error         // error of (*Consumer).SetQos(), if any
+	At      time.Time
+}
+
+// PrefetchControllerOpt is a PrefetchController's functional option type
+type PrefetchControllerOpt func(*PrefetchController)
+
+// PrefetchController adjusts prefetch of a Consumer to keep its workers busy
+// without hoarding messages. Handlers report processing time with Observe()
+// or Measure(); once per interval prefetch is set to the number of messages
+// being processed (ack rate × latency, Little's law) plus a buffer of
+// messages for buffer time, within [min, max]. While all prefetched messages
+// are being processed, workers may starve, so prefetch is doubled.
+type PrefetchController struct {
+	min      int
+	max      int
+	interval time.Duration
+	buffer   time.Duration
+	events   chan PrefetchEvent
+	now      func() time.Time
+
+	consumer *Consumer
+	start    time.Time // window start
+	count    int
+	total    time.Duration
+	l        sync.Mutex
+}
+
+// NewPrefetchController creates PrefetchController keeping prefetch within
+// [min, max]. It's attached to a consumer with AdaptivePrefetch() option.
+// min is at least 1, as zero prefetch means no limit.
+func NewPrefetchController(min, max int, opts ...PrefetchControllerOpt) *PrefetchController {
+	if min < 1 {
+		min = 1
+	}
+
+	pc := &PrefetchController{
+		min:      min,
+		max:      max,
+		interval: 5 * time.Second,
+		buffer:   100 * time.Millisecond,
+		events:   make(chan PrefetchEvent, 10),
+		now:      time.Now,
+	}
+	for _, o := range opts {
+		o(pc)
+	}
+	return pc
+}
+
+// PrefetchInterval is a PrefetchController's functional option, how often
+// prefetch is adjusted. Default is 5 seconds.
+func PrefetchInterval(d time.Duration) PrefetchControllerOpt {
+	return func(pc *PrefetchController) {
+		pc.interval = d
+	}
+}
+
+// PrefetchBuffer is a PrefetchController's functional option, for how long
+// workers should have messages buffered in addition to ones being processed.
+// Default is 100 milliseconds.
+func PrefetchBuffer(d time.Duration) PrefetchControllerOpt {
+	return func(pc *PrefetchController) {
+		pc.buffer = d
+	}
+}
+
+// PrefetchEvents is a PrefetchController's functional option, used to
+// initialize decisions channel in client code, maintaining control over
+// buffer size. Default buffer size is 10. Events will be dropped in case if
+// receiver can't keep up.
+func PrefetchEvents(events chan PrefetchEvent) PrefetchControllerOpt {
+	return func(pc *PrefetchController) {
+		pc.events = events
+	}
+}
+
+// AdaptivePrefetch attaches PrefetchController to the consumer. Prefetch
+// starts at Qos() value, clamped to controller bounds. It implies GlobalQos,
+// so the controller could raise prefetch of the running consumer, see
+// (*Consumer).SetQos().
+func AdaptivePrefetch(pc *PrefetchController) ConsumerOpt {
+	return func(c *Consumer) {
+		pc.consumer = c
+		c.adaptive = pc
+		c.qosGlobal = true
+	}
+}
+
+// Events returns prefetch changes
+func (pc *PrefetchController) Events() <-chan PrefetchEvent {
+	return pc.events
+}
+
+// Measure runs handler f and observes its latency
+func (pc *PrefetchController) Measure(f func() error) error {
+	start := pc.now()
+	err := f()
+	pc.Observe(pc.now().Sub(start))
+	return err
+}
+
+// Observe reports that a message was processed (acknowledged) in latency
+func (pc *PrefetchController) Observe(latency time.Duration) {
+	pc.l.Lock()
+
+	now := pc.now()
+	if pc.start.IsZero() {
+		pc.start = now
+	}
+
+	pc.count++
+	pc.total += latency
+
+	elapsed := now.Sub(pc.start)
+	if elapsed < pc.interval || pc.consumer == nil {
+		pc.l.Unlock()
+		return
+	}
+
+	avg := pc.total / time.Duration(pc.count)
+	rate := float64(pc.count) / elapsed.Seconds()
+	pc.start, pc.count, pc.total = now, 0, 0
+	pc.l.Unlock()
+
+	pc.adjust(avg, rate, now)
+}
+
+// adjust sets prefetch for observed average latency and ack rate
+func (pc *PrefetchController) adjust(avg time.Duration, rate float64, now time.Time) {
+	c := pc.consumer
+	c.m.Lock()
+	current := c.qos
+	c.m.Unlock()
+
+	busy := rate * avg.Seconds()
+	next := int(math.Ceil(busy + rate*pc.buffer.Seconds()))
+	if next <= current && busy >= 0.9*float64(current) {
+		next = current * 2
+	}
+	next = pc.clamp(next)
+
+	if next == current {
+		return
+	}
+
+	e := PrefetchEvent{
+		From:    current,
+		To:      next,
+		Latency: avg,
+		AckRate: rate,
+		Err:     c.SetQos(next),
+		At:      now,
+	}
+
+	select {
+	case pc.events <- e:
+	default:
+	}
+}
+
+func (pc *PrefetchController) clamp(n int) int {
+	if n < pc.min {
+		return pc.min
+	}
+	if pc.max > 0 && n > pc.max {
+		return pc.max
+	}
+	return n
+}
@@ -0,0 +1,134 @@
+package cony
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPrefetchController(t *testing.T) {
+	clock := &testClock{t: time.Unix(0, 0)}
+	pc := NewPrefetchController(1, 50, PrefetchInterval(time.Second), PrefetchBuffer(100*time.Millisecond))
+	pc.now = clock.now
+
+	c := newTestConsumer(Qos(100), AdaptivePrefetch(pc))
+	if c.qos != 50 {
+		t.Error("should clamp initial prefetch, got", c.qos)
+	}
+
+	// 100 messages per second, 10ms each: 1 busy worker, 10 buffered
+	for i := 0; i <= 100; i++ {
+		pc.Observe(10 * time.Millisecond)
+		clock.t = clock.t.Add(10 * time.Millisecond)
+	}
+
+	e := <-pc.Events()
+	if e.From != 50 || e.To < 11 || e.To > 12 || e.Latency != 10*time.Millisecond {
+		t.Errorf("should shrink hoarded prefetch, got %+v", e)
+	}
+
+	if c.qos != e.To {
+		t.Error("should set consumer prefetch, got", c.qos)
+	}
+
+	// 100 messages per second, 50ms each: 5 busy workers, 10 buffered
+	for i := 0; i < 100; i++ {
+		clock.t = clock.t.Add(10 * time.Millisecond)
+		pc.Observe(50 * time.Millisecond)
+	}
+
+	if e := <-pc.Events(); e.To != 15 {
+		t.Errorf("should follow handler latency, got %+v", e)
+	}
+
+	for i := 0; i < 100; i++ {
+		clock.t = clock.t.Add(10 * time.Millisecond)
+		pc.Observe(50 * time.Millisecond)
+	}
+
+	if len(pc.Events()) != 0 {
+		t.Error("should keep prefetch which fits, got", <-pc.Events())
+	}
+}
+
+func TestAdaptivePrefetch(t *testing.T) {
+	pc := NewPrefetchController(1, 50)
+
+	c := newTestConsumer(AdaptivePrefetch(pc), Qos(100))
+	if c.qos != 50 {
+		t.Error("should clamp prefetch set after the controller, got", c.qos)
+	}
+
+	if !c.qosGlobal {
+		t.Error("should set prefetch per channel")
+	}
+
+	if newTestConsumer(AdaptivePrefetch(NewPrefetchController(5, 50))).qos != 5 {
+		t.Error("should clamp default prefetch")
+	}
+}
+
+func TestAdaptivePrefetch_running(t *testing.T) {
+	pc := NewPrefetchController(1, 50)
+	c := newTestConsumer(Qos(10), AdaptivePrefetch(pc))
+	c.attach()
+
+	ch := newQosChannel()
+	done := make(chan bool)
+	go func() {
+		c.serve(&mqDeleterTest{}, ch)
+		done <- true
+	}()
+	<-ch.consumeStart
+
+	// 100 messages per second, 50ms each: 5 busy workers, 10 buffered
+	pc.adjust(50*time.Millisecond, 100, time.Now())
+
+	if e := <-pc.Events(); e.To != 15 || e.Err != nil {
+		t.Errorf("should raise prefetch, got %+v", e)
+	}
+
+	if p := ch.prefetch(); p != 15 {
+		t.Error("running consumer should get raised prefetch, got", p)
+	}
+
+	c.detach()
+	<-done
+}
+
+func TestPrefetchController_starving(t *testing.T) {
+	clock := &testClock{t: time.Unix(0, 0)}
+	pc := NewPrefetchController(1, 50, PrefetchInterval(time.Second), PrefetchBuffer(0))
+	pc.now = clock.now
+
+	c := newTestConsumer(Qos(10), AdaptivePrefetch(pc))
+
+	// 100 messages per second, 90ms each: nearly all prefetched messages
+	// are being processed
+	for i := 0; i <= 100; i++ {
+		pc.Observe(90 * time.Millisecond)
+		clock.t = clock.t.Add(10 * time.Millisecond)
+	}
+
+	if e := <-pc.Events(); e.From != 10 || e.To != 20 || c.qos != 20 {
+		t.Errorf("should double starving prefetch, got %+v", e)
+	}
+}
+
+func TestPrefetchController_Measure(t *testing.T) {
+	pc := NewPrefetchController(0, 0)
+	if pc.min != 1 {
+		t.Error("should keep prefetch limited")
+	}
+
+	clock := &testClock{t: time.Unix(0, 0)}
+	pc.now = clock.now
+
+	pc.Measure(func() error {
+		clock.t = clock.t.Add(time.Second)
+		return nil
+	})
+
+	if pc.count != 1 || pc.total != time.Second {
+		t.Error("should observe handler latency")
+	}
+}
@@ -1,10 +1,11 @@
 package cony
 
 import (
+	"context"
 	"errors"
 	"sync"
 
-	"github.com/streadway/amqp"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 // ErrPublisherDead indicates that publisher was canceled, could be returned
@@ -22,13 +23,18 @@ type publishMaybeErr struct {
 
 // Publisher hold definition for AMQP publishing
 type Publisher struct {
-	exchange string
-	key      string
-	tmpl     amqp.Publishing
-	pubChan  chan publishMaybeErr
-	stop     chan struct{}
-	dead     bool
-	m        sync.Mutex
+	exchange  string
+	key       string
+	tmpl      amqp.Publishing
+	outbox    Outbox
+	onBlocked BlockedPolicy
+	pubChan   chan publishMaybeErr
+	stop      chan struct{}
+	detached  chan struct{} // closed by (*Client).UnregisterPublisher()
+	flow      *flow         // blocked state of the connection
+	breaker   *CircuitBreaker
+	dead      bool
+	m         sync.Mutex
 }
 
 // Template will be used, input buffer will be added as Publishing.Body.
@@ -49,6 +55,33 @@ func (p *Publisher) Write(b []byte) (int, error) {
 // WARNING: this is blocking call, it will not return until connection is
 // available. The only way to stop it is to use Cancel() method.
 func (p *Publisher) PublishWithRoutingKey(pub amqp.Publishing, key string) error {
+	return p.PublishWithContext(context.Background(), pub, key)
+}
+
+// PublishWithContext used to publish custom amqp.Publishing and routing key,
+// waiting for connection (or for unblocking, see OnBlocked) no longer than ctx
+// allows. Once publishing is handed over to the connection, it's not
+// interrupted by ctx.
+func (p *Publisher) PublishWithContext(ctx context.Context, pub amqp.Publishing, key string) error {
+	if handled, err := p.checkBlocked(ctx, pub, key); handled || err != nil {
+		return err
+	}
+
+	if p.breaker == nil {
+		return p.publish(ctx, pub, key)
+	}
+
+	if err := p.breaker.Allow(); err != nil {
+		return err
+	}
+
+	err := p.publish(ctx, pub, key)
+	publishResult(p.breaker, err)
+	return err
+}
+
+func (p *Publisher) publish(ctx context.Context, pub amqp.Publishing, key string) error {
+
 	reqRepl := publishMaybeErr{
 		pub: make(chan amqp.Publishing, 2),
 		err: make(chan error, 2),
@@ -61,6 +94,8 @@ func (p *Publisher) PublishWithRoutingKey(pub amqp.Publishing, key string) error
 	case <-p.stop:
 		// received stop signal
 		return ErrPublisherDead
+	case <-ctx.Done():
+		return ctx.Err()
 	case p.pubChan <- reqRepl:
 	}
 
@@ -87,7 +122,78 @@ func (p *Publisher) Cancel() {
 	}
 }
 
+// attach is called when publisher is registered on a Client. Publisher
+// registered again is detached from its previous serve goroutine first.
+func (p *Publisher) attach(f *flow) {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.detached != nil {
+		close(p.detached)
+	}
+	p.detached = make(chan struct{})
+	p.flow = f
+}
+
+// detach stops serving the publisher, without canceling it
+func (p *Publisher) detach() {
+	p.m.Lock()
+	defer p.m.Unlock()
+	if p.detached != nil {
+		close(p.detached)
+		p.detached = nil
+	}
+}
+
+func (p *Publisher) detachedChan() <-chan struct{} {
+	p.m.Lock()
+	defer p.m.Unlock()
+	return p.detached
+}
+
+// serve publishes on ch until the publisher is canceled or detached. If only
+// the channel dies (channel exception), it's reopened with backoff on the same
+// connection; serve returns once the connection is gone, publisher is served
+// again after reconnect.
 func (p *Publisher) serve(client mqDeleter, ch mqChannel) {
+	detached := p.detachedChan()
+
+	for attempt := 0; ; attempt++ {
+		stopped, published := p.publishOn(client, ch, detached)
+		if stopped {
+			return
+		}
+
+		if published {
+			attempt = 0
+		}
+
+		var err error
+		ch, err = reopenChannel(client, attempt, p.stop, detached)
+		switch err {
+		case nil:
+		case errStopped:
+			select {
+			case <-detached:
+			default:
+				client.deletePublisher(p)
+			}
+			return
+		case ErrNoConnection:
+			return
+		default:
+			ch = nil
+		}
+	}
+}
+
+// publishOn serves publishings on ch. It returns stopped once the publisher is
+// canceled or detached, published tells whether anything was published before
+// the channel died.
+func (p *Publisher) publishOn(client mqDeleter, ch mqChannel, detached <-chan struct{}) (stopped, published bool) {
+	if ch == nil {
+		return false, false
+	}
+
 	chanErrs := make(chan *amqp.Error)
 	ch.NotifyClose(chanErrs)
 
@@ -96,9 +202,12 @@ func (p *Publisher) serve(client mqDeleter, ch mqChannel) {
 		case <-p.stop:
 			client.deletePublisher(p)
 			ch.Close()
-			return
+			return true, published
+		case <-detached:
+			ch.Close()
+			return true, published
 		case <-chanErrs:
-			return
+			return false, published
 		case envelop := <-p.pubChan:
 			msg := <-envelop.pub
 			close(envelop.pub)
@@ -110,6 +219,8 @@ func (p *Publisher) serve(client mqDeleter, ch mqChannel) {
 				msg,         // msg amqp.Publishing
 			); err != nil {
 				envelop.err <- err
+			} else {
+				published = true
 			}
 			close(envelop.err)
 		}
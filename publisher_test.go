@@ -6,7 +6,7 @@ import (
 	"io"
 	"testing"
 
-	"github.com/streadway/amqp"
+	amqp "github.com/rabbitmq/amqp091-go"
 )
 
 func TestPublisherImplements_io_Writer(t *testing.T) {
@@ -355,3 +355,59 @@ func TestPublishingTemplate(t *testing.T) {
 func newTestPublisher(opts ...PublisherOpt) *Publisher {
 	return NewPublisher("exchange.name", "routing.key", opts...)
 }
+
+func TestPublisher_serve_reopen(t *testing.T) {
+	var (
+		done      = make(chan bool)
+		published = make(chan string, 1)
+	)
+
+	newCh := func(name string, notify *chan *amqp.Error) *mqChannelTest {
+		return &mqChannelTest{
+			_NotifyClose: func(c chan *amqp.Error) chan *amqp.Error {
+				*notify = c
+				return c
+			},
+			_Publish: func(string, string, bool, bool, amqp.Publishing) error {
+				published <- name
+				return nil
+			},
+			_Close: func() error {
+				return nil
+			},
+		}
+	}
+
+	var notify1, notify2 chan *amqp.Error
+	ch1 := newCh("ch1", &notify1)
+
+	cli := &mqDeleterTest{
+		_deletePublisher: func(*Publisher) {},
+		_reopenChannel: func() (mqChannel, error) {
+			return newCh("ch2", &notify2), nil
+		},
+	}
+
+	p := newTestPublisher()
+	p.attach(nil)
+
+	go func() {
+		p.serve(cli, ch1)
+		done <- true
+	}()
+
+	p.Write([]byte("test1"))
+	if <-published != "ch1" {
+		t.Error("should publish on the first channel")
+	}
+
+	close(notify1) // imitate channel exception
+
+	p.Write([]byte("test2"))
+	if <-published != "ch2" {
+		t.Error("should publish on reopened channel")
+	}
+
+	p.Cancel()
+	<-done
+}
@@ -0,0 +1,218 @@
+package cony
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// OffsetStore keeps committed offsets of stream consumers by consumer name
+type OffsetStore interface {
+	// Load returns committed offset, false if there is none
+	Load(name string) (int64, bool, error)
+	Save(name string, offset int64) error
+}
+
+// MemoryOffsetStore is OffsetStore which keeps offsets in memory, i.e. for
+// the lifetime of the process
+type MemoryOffsetStore struct {
+	offsets map[string]int64
+	l       sync.Mutex
+}
+
+// NewMemoryOffsetStore is a MemoryOffsetStore constructor
+func NewMemoryOffsetStore() *MemoryOffsetStore {
+	return &MemoryOffsetStore{offsets: make(map[string]int64)}
+}
+
+// Load implements OffsetStore
+func (s *MemoryOffsetStore) Load(name string) (int64, bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	offset, ok := s.offsets[name]
+	return offset, ok, nil
+}
+
+// Save implements OffsetStore
+func (s *MemoryOffsetStore) Save(name string, offset int64) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.offsets[name] = offset
+	return nil
+}
+
+// FileOffsetStore is OffsetStore which keeps offsets of all consumers in a
+// JSON file. File is replaced atomically on every save.
+type FileOffsetStore struct {
+	path string
+	l    sync.Mutex
+}
+
+// NewFileOffsetStore is a FileOffsetStore constructor, file is created on
+// first save
+func NewFileOffsetStore(path string) *FileOffsetStore {
+	return &FileOffsetStore{path: path}
+}
+
+// Load implements OffsetStore
+func (s *FileOffsetStore) Load(name string) (int64, bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	offsets, err := s.read()
+	if err != nil {
+		return 0, false, err
+	}
+
+	offset, ok := offsets[name]
+	return offset, ok, nil
+}
+
+// Save implements OffsetStore
+func (s *FileOffsetStore) Save(name string, offset int64) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	offsets, err := s.read()
+	if err != nil {
+		return err
+	}
+	offsets[name] = offset
+
+	b, err := json.Marshal(offsets)
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), s.path)
+}
+
+func (s *FileOffsetStore) read() (map[string]int64, error) {
+	offsets := make(map[string]int64)
+
+	b, err := os.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return offsets, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := json.Unmarshal(b, &offsets); err != nil {
+		return nil, err
+	}
+	return offsets, nil
+}
+
+// StreamHandler processes a stream message, offset is committed once it
+// returns nil
+type StreamHandler func(amqp.Delivery) error
+
+// StreamConsumer consumes RabbitMQ stream queue, committing offsets of
+// processed messages to OffsetStore. It resumes after the committed offset
+// when Client reconnects, and when it's created again with the same name.
+type StreamConsumer struct {
+	*Consumer
+	name  string
+	store OffsetStore
+}
+
+// NewStreamConsumer creates StreamConsumer of stream queue q. Name identifies
+// the consumer in the store. Consumer options could set prefetch (100 by
+// default, streams require one) and offset to start from, if nothing was
+// committed yet (StreamOffsetFirst by default).
+func NewStreamConsumer(q *Queue, name string, store OffsetStore, opts ...ConsumerOpt) (*StreamConsumer, error) {
+	offset, ok, err := store.Load(name)
+	if err != nil {
+		return nil, err
+	}
+
+	opts = append([]ConsumerOpt{Qos(100), StreamOffsetFirst()}, opts...)
+	if ok {
+		opts = append(opts, StreamOffsetAt(offset+1))
+	}
+
+	c := NewConsumer(q, opts...)
+	c.committed = true
+	if ok {
+		c.setOffset(offset)
+	}
+
+	return &StreamConsumer{
+		Consumer: c,
+		name:     name,
+		store:    store,
+	}, nil
+}
+
+// Handle processes deliveries with h until ctx is done or consumer is
+// canceled. Every message is acknowledged, offset is committed after h
+// succeeds. Handle stops on the first error of h or of the store, the
+// message is not committed then and is delivered again once consumer is
+// created again.
+func (sc *StreamConsumer) Handle(ctx context.Context, h StreamHandler) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case d, ok := <-sc.Deliveries():
+			if !ok {
+				return nil
+			}
+
+			if err := h(d); err != nil {
+				return err
+			}
+
+			if err := sc.commit(d); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// commit saves offset of processed message and acknowledges it, so server
+// grants credit for more messages
+func (sc *StreamConsumer) commit(d amqp.Delivery) error {
+	if offset, ok := streamOffset(d); ok {
+		if err := sc.store.Save(sc.name, offset); err != nil {
+			return err
+		}
+		sc.setOffset(offset)
+	}
+
+	if d.Acknowledger == nil {
+		return nil
+	}
+
+	// offset is committed anyway, stale delivery is not redelivered as
+	// consumer resumes after it
+	if err := d.Ack(false); err != nil && err != ErrStaleDelivery {
+		return err
+	}
+	return nil
+}
+
+// ConsumeStream registers stream consumer, like Consume() does
+func (c *Client) ConsumeStream(sc *StreamConsumer) {
+	c.Consume(sc.Consumer)
+}
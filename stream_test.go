@@ -0,0 +1,143 @@
+package cony
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type testAcknowledger struct {
+	acked  []uint64
+	nacked []uint64
+	l      sync.Mutex
+}
+
+func (a *testAcknowledger) Ack(tag uint64, multiple bool) error {
+	a.l.Lock()
+	defer a.l.Unlock()
+	a.acked = append(a.acked, tag)
+	return nil
+}
+
+func (a *testAcknowledger) Nack(tag uint64, multiple bool, requeue bool) error {
+	a.l.Lock()
+	defer a.l.Unlock()
+	a.nacked = append(a.nacked, tag)
+	return nil
+}
+
+func (a *testAcknowledger) Reject(tag uint64, requeue bool) error {
+	return nil
+}
+
+func TestFileOffsetStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "offsets.json")
+	s := NewFileOffsetStore(path)
+
+	if _, ok, err := s.Load("c1"); ok || err != nil {
+		t.Error("should have no offset initially", err)
+	}
+
+	if err := s.Save("c1", 10); err != nil {
+		t.Fatal(err)
+	}
+	s.Save("c2", 20)
+	s.Save("c1", 11)
+
+	s = NewFileOffsetStore(path)
+	if offset, ok, _ := s.Load("c1"); !ok || offset != 11 {
+		t.Error("should load saved offset, got", offset)
+	}
+	if offset, _, _ := s.Load("c2"); offset != 20 {
+		t.Error("should keep offsets of other consumers, got", offset)
+	}
+}
+
+func TestMemoryOffsetStore(t *testing.T) {
+	s := NewMemoryOffsetStore()
+	s.Save("c1", 5)
+
+	if offset, ok, _ := s.Load("c1"); !ok || offset != 5 {
+		t.Error("should load saved offset")
+	}
+}
+
+func TestNewStreamConsumer(t *testing.T) {
+	s := NewMemoryOffsetStore()
+
+	sc, err := NewStreamConsumer(&Queue{Name: "stream"}, "c1", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	args := sc.consumeArgs()
+	if args["x-stream-offset"] != "first" || sc.qos != 100 {
+		t.Error("should start from the first message with prefetch, got", args, sc.qos)
+	}
+
+	sc, _ = NewStreamConsumer(&Queue{Name: "stream"}, "c1", s, StreamOffsetNext(), Qos(10))
+	if sc.consumeArgs()["x-stream-offset"] != "next" || sc.qos != 10 {
+		t.Error("should apply consumer options")
+	}
+
+	s.Save("c1", 41)
+	sc, _ = NewStreamConsumer(&Queue{Name: "stream"}, "c1", s, StreamOffsetNext())
+	if offset := sc.consumeArgs()["x-stream-offset"]; offset != int64(42) {
+		t.Error("should resume after committed offset, got", offset)
+	}
+}
+
+func TestStreamConsumer_Handle(t *testing.T) {
+	s := NewMemoryOffsetStore()
+	sc, _ := NewStreamConsumer(&Queue{Name: "stream"}, "c1", s)
+	ack := &testAcknowledger{}
+	handleErr := errors.New("handle")
+
+	go func() {
+		for i := int64(1); i <= 3; i++ {
+			sc.deliveries <- amqp.Delivery{
+				Acknowledger: ack,
+				DeliveryTag:  uint64(i),
+				Headers:      amqp.Table{"x-stream-offset": i},
+			}
+		}
+	}()
+
+	err := sc.Handle(context.Background(), func(d amqp.Delivery) error {
+		if d.DeliveryTag == 3 {
+			return handleErr
+		}
+		return nil
+	})
+
+	if err != handleErr {
+		t.Error("should stop on handler error, got", err)
+	}
+
+	if offset, _, _ := s.Load("c1"); offset != 2 {
+		t.Error("should commit offset of processed messages only, got", offset)
+	}
+
+	if len(ack.acked) != 2 {
+		t.Error("should ack processed messages, got", ack.acked)
+	}
+
+	if offset := sc.consumeArgs()["x-stream-offset"]; offset != int64(3) {
+		t.Error("should resume after committed offset on reconnect, got", offset)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := sc.Handle(ctx, nil); err != context.Canceled {
+		t.Error("should stop once ctx is done, got", err)
+	}
+
+	sc.Cancel()
+	if err := sc.Handle(context.Background(), nil); err != nil {
+		t.Error("should return nil once consumer is canceled, got", err)
+	}
+}
@@ -0,0 +1,160 @@
+package cony
+
+import (
+	"sort"
+	"sync"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// unbinder is implemented by *amqp.Channel
+type unbinder interface {
+	QueueUnbind(name, key, exchange string, args amqp.Table) error
+}
+
+// Subscription is a dynamic set of binding keys between a Queue and an
+// Exchange, e.g. per-tenant routing keys on a topic exchange. Keys could be
+// added and removed at any time, changes are applied immediately when Client
+// is connected and the current set is re-applied on every reconnect.
+type Subscription struct {
+	q       *Queue
+	ex      Exchange
+	keys    map[string]struct{}
+	removed map[string]struct{} // removed while disconnected, to unbind on reconnect
+	client  *Client
+	l       sync.Mutex
+}
+
+// NewSubscription is a Subscription constructor
+func NewSubscription(q *Queue, ex Exchange, keys ...string) *Subscription {
+	s := &Subscription{
+		q:       q,
+		ex:      ex,
+		keys:    make(map[string]struct{}),
+		removed: make(map[string]struct{}),
+	}
+
+	for _, key := range keys {
+		s.keys[key] = struct{}{}
+	}
+	return s
+}
+
+// Subscribe registers Subscription on the Client. Subscription is a
+// declaration depending on its Queue and Exchange, the same rules as for
+// (*Client).Declare() apply.
+func (c *Client) Subscribe(s *Subscription) (*DeclarationHandle, error) {
+	s.l.Lock()
+	s.client = c
+	s.l.Unlock()
+
+	return c.Declare([]Declaration{s.declare})
+}
+
+// Keys returns current binding keys, sorted
+func (s *Subscription) Keys() []string {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	keys := make([]string, 0, len(s.keys))
+	for key := range s.keys {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// Add binds the key. If Client is not connected, binding is postponed until
+// connection is established. Error is returned only if the server refused the
+// binding, the key is not added in that case.
+func (s *Subscription) Add(key string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if _, ok := s.keys[key]; ok {
+		return nil
+	}
+
+	err := s.apply(func(ch amqpChannel) error {
+		return ch.QueueBind(s.q.name(), key, s.ex.Name, false, nil)
+	})
+	if err != nil && err != ErrNoConnection {
+		return err
+	}
+
+	s.keys[key] = struct{}{}
+	delete(s.removed, key)
+	return nil
+}
+
+// Remove unbinds the key. If Client is not connected, key is unbound on
+// reconnect. Error is returned only if the server refused to unbind, the key
+// is kept in that case.
+func (s *Subscription) Remove(key string) error {
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if _, ok := s.keys[key]; !ok {
+		return nil
+	}
+
+	err := s.apply(func(ch amqpChannel) error {
+		return ch.QueueUnbind(s.q.name(), key, s.ex.Name, nil)
+	})
+	if err == ErrNoConnection {
+		s.removed[key] = struct{}{}
+	} else if err != nil {
+		return err
+	}
+
+	delete(s.keys, key)
+	return nil
+}
+
+// apply runs f on a channel of the Client, if it's connected
+func (s *Subscription) apply(f func(amqpChannel) error) error {
+	if s.client == nil {
+		return ErrNoConnection
+	}
+	return s.client.withChannel(f)
+}
+
+// declare is the Declaration registered on a Client: it unbinds keys removed
+// while disconnected and binds the current set
+func (s *Subscription) declare(c Declarer) error {
+	if in, ok := c.(inspector); ok {
+		in.inspectSubscription(s)
+		return nil
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+
+	if ub, ok := c.(unbinder); ok {
+		for key := range s.removed {
+			if err := ub.QueueUnbind(s.q.name(), key, s.ex.Name, nil); err != nil {
+				return err
+			}
+			delete(s.removed, key)
+		}
+	}
+
+	for key := range s.keys {
+		if err := c.QueueBind(s.q.name(), key, s.ex.Name, false, nil); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// bindings returns Subscription as a list of bindings
+func (s *Subscription) bindings() []Binding {
+	keys := s.Keys()
+	bs := make([]Binding, 0, len(keys))
+	for _, key := range keys {
+		bs = append(bs, Binding{Queue: s.q, Exchange: s.ex, Key: key})
+	}
+	return bs
+}
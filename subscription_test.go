@@ -0,0 +1,85 @@
+package cony
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type testSubscriptionDeclarer struct {
+	testDeclarer
+	bound   []string
+	unbound []string
+}
+
+func (td *testSubscriptionDeclarer) QueueBind(name, key, exchange string,
+	noWait bool, args amqp.Table) error {
+	td.bound = append(td.bound, key)
+	return nil
+}
+
+func (td *testSubscriptionDeclarer) QueueUnbind(name, key, exchange string,
+	args amqp.Table) error {
+	td.unbound = append(td.unbound, key)
+	return nil
+}
+
+func TestSubscription(t *testing.T) {
+	q := &Queue{Name: "q1"}
+	ex := Exchange{Name: "ex1", Kind: "topic"}
+	s := NewSubscription(q, ex, "tenant1.#", "tenant2.#")
+
+	c := NewClient()
+	c.Declare([]Declaration{DeclareQueue(q), DeclareExchange(ex)})
+	if _, err := c.Subscribe(s); err != nil {
+		t.Fatal(err)
+	}
+
+	// not connected, changes are postponed
+	if err := s.Add("tenant3.#"); err != nil {
+		t.Error("should postpone Add, got", err)
+	}
+
+	if err := s.Remove("tenant1.#"); err != nil {
+		t.Error("should postpone Remove, got", err)
+	}
+
+	if !reflect.DeepEqual(s.Keys(), []string{"tenant2.#", "tenant3.#"}) {
+		t.Error("unexpected keys", s.Keys())
+	}
+
+	// imitate reconnect, subscription goes after queue and exchange
+	td := &testSubscriptionDeclarer{}
+	c.declarations[2].declare(td)
+
+	sort.Strings(td.bound)
+	if !reflect.DeepEqual(td.bound, []string{"tenant2.#", "tenant3.#"}) {
+		t.Error("should bind current keys on reconnect, got", td.bound)
+	}
+
+	if !reflect.DeepEqual(td.unbound, []string{"tenant1.#"}) {
+		t.Error("should unbind keys removed while disconnected, got", td.unbound)
+	}
+
+	td = &testSubscriptionDeclarer{}
+	s.declare(td)
+	if len(td.unbound) != 0 {
+		t.Error("removed keys should be unbound once")
+	}
+
+	defs := c.Definitions()
+	if len(defs.Bindings) != 2 {
+		t.Error("should export subscription bindings, got", defs.Bindings)
+	}
+}
+
+func TestClient_Subscribe_missing(t *testing.T) {
+	c := NewClient()
+	s := NewSubscription(&Queue{Name: "q1"}, Exchange{Name: "ex1"})
+
+	if _, err := c.Subscribe(s); err == nil {
+		t.Error("should refuse subscription without declared queue and exchange")
+	}
+}
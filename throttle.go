@@ -0,0 +1,172 @@
+package cony
+
+import (
+	"sync"
+	"time"
+)
+
+// tokenBucket is a rate limiter, allowing bursts of up to burst events
+type tokenBucket struct {
+	rate   float64 // tokens per second
+	burst  float64
+	tokens float64
+	last   time.Time
+	now    func() time.Time
+	l      sync.Mutex
+}
+
+func newTokenBucket(rate float64, burst int) *tokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		now:    time.Now,
+	}
+}
+
+// reserve takes a token and returns how long to wait until it's available
+func (b *tokenBucket) reserve() time.Duration {
+	b.l.Lock()
+	defer b.l.Unlock()
+
+	now := b.now()
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+
+	b.tokens--
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// slotLedger keeps concurrency slots held by unacknowledged deliveries of a
+// channel
+type slotLedger struct {
+	slots  chan struct{}
+	held   map[uint64]struct{} // delivery tags
+	closed bool
+	l      sync.Mutex
+}
+
+func newSlotLedger(slots chan struct{}) *slotLedger {
+	if slots == nil {
+		return nil
+	}
+	return &slotLedger{slots: slots, held: make(map[uint64]struct{})}
+}
+
+func (sl *slotLedger) hold(tag uint64) {
+	sl.l.Lock()
+	defer sl.l.Unlock()
+	sl.held[tag] = struct{}{}
+}
+
+// settle frees slots of acknowledged deliveries, with multiple flag all of
+// them up to tag
+func (sl *slotLedger) settle(tag uint64, multiple bool) {
+	if sl == nil {
+		return
+	}
+
+	sl.l.Lock()
+	defer sl.l.Unlock()
+
+	if sl.closed {
+		return
+	}
+
+	for t := range sl.held {
+		if t == tag || multiple && t < tag {
+			delete(sl.held, t)
+			<-sl.slots
+		}
+	}
+}
+
+// close frees all slots once the channel is gone, its deliveries are
+// redelivered by the server
+func (sl *slotLedger) close() {
+	if sl == nil {
+		return
+	}
+
+	sl.l.Lock()
+	defer sl.l.Unlock()
+
+	sl.closed = true
+	for t := range sl.held {
+		delete(sl.held, t)
+		<-sl.slots
+	}
+}
+
+// throttle waits until delivery could be handed to the application,
+// according to rate limit and concurrency cap. It returns false if consumer
+// is canceled or detached meanwhile.
+func (c *Consumer) throttle(tag uint64, ledger *slotLedger, detached <-chan struct{}) bool {
+	if c.limiter != nil {
+		if d := c.limiter.reserve(); d > 0 {
+			t := time.NewTimer(d)
+			defer t.Stop()
+
+			select {
+			case <-t.C:
+			case <-c.stop:
+				return false
+			case <-detached:
+				return false
+			}
+		}
+	}
+
+	if ledger != nil {
+		select {
+		case ledger.slots <- struct{}{}:
+			ledger.hold(tag)
+		case <-c.stop:
+			return false
+		case <-detached:
+			return false
+		}
+	}
+
+	return true
+}
+
+// RateLimit limits deliveries to rate per second, allowing bursts of up to
+// burst messages. Consumer waits before pulling next delivery, so messages
+// stay on the server, limited by prefetch. Non-positive rate is ignored.
+func RateLimit(rate float64, burst int) ConsumerOpt {
+	return func(c *Consumer) {
+		if rate <= 0 {
+			return
+		}
+		c.limiter = newTokenBucket(rate, burst)
+	}
+}
+
+// MaxConcurrency caps the number of deliveries handed to the application and
+// not acknowledged yet. Consumer waits for Ack(), Nack() or Reject() before
+// pulling next delivery. Prefetch is set to n, unless Qos() is set. It has no
+// effect with AutoAck(). Non-positive n is ignored.
+func MaxConcurrency(n int) ConsumerOpt {
+	return func(c *Consumer) {
+		if n < 1 {
+			return
+		}
+		c.slots = make(chan struct{}, n)
+		if c.qos == 0 {
+			c.qos = n
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package cony
+
+import (
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+func TestTokenBucket(t *testing.T) {
+	clock := &testClock{t: time.Unix(0, 0)}
+	b := newTokenBucket(10, 2)
+	b.now = clock.now
+
+	if b.reserve() != 0 || b.reserve() != 0 {
+		t.Error("should allow burst")
+	}
+
+	if d := b.reserve(); d != 100*time.Millisecond {
+		t.Error("should wait for next token, got", d)
+	}
+
+	clock.t = clock.t.Add(time.Second)
+	if b.reserve() != 0 || b.reserve() != 0 {
+		t.Error("should refill up to burst")
+	}
+
+	if d := b.reserve(); d != 100*time.Millisecond {
+		t.Error("should not accumulate more than burst, got", d)
+	}
+}
+
+func TestSlotLedger(t *testing.T) {
+	slots := make(chan struct{}, 4)
+	sl := newSlotLedger(slots)
+
+	for tag := uint64(1); tag <= 4; tag++ {
+		slots <- struct{}{}
+		sl.hold(tag)
+	}
+
+	sl.settle(2, false)
+	sl.settle(2, false)
+	if len(slots) != 3 {
+		t.Error("should free slot once, held", len(slots))
+	}
+
+	sl.settle(3, true)
+	if len(slots) != 1 {
+		t.Error("should free slots up to tag, held", len(slots))
+	}
+
+	sl.close()
+	sl.settle(4, false)
+	if len(slots) != 0 {
+		t.Error("should free all slots on close, held", len(slots))
+	}
+
+	if newSlotLedger(nil) != nil {
+		t.Error("should not track slots without concurrency cap")
+	}
+}
+
+func TestConsumer_MaxConcurrency(t *testing.T) {
+	var (
+		ack        = &testAcknowledger{}
+		done       = make(chan bool)
+		deliveries = make(chan amqp.Delivery, 3)
+	)
+
+	c := newTestConsumer(MaxConcurrency(2))
+	c.attach()
+
+	if c.qos != 2 {
+		t.Error("should set prefetch to concurrency cap, got", c.qos)
+	}
+
+	ch1 := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+			return deliveries, nil
+		},
+		_Close: func() error {
+			return nil
+		},
+	}
+
+	go func() {
+		c.serve(&mqDeleterTest{}, ch1)
+		done <- true
+	}()
+
+	for tag := uint64(1); tag <= 3; tag++ {
+		deliveries <- amqp.Delivery{Acknowledger: ack, DeliveryTag: tag}
+	}
+
+	d1 := <-c.Deliveries()
+	<-c.Deliveries()
+
+	select {
+	case <-c.Deliveries():
+		t.Fatal("should not exceed concurrency cap")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	d1.Ack(false)
+
+	select {
+	case d := <-c.Deliveries():
+		if d.DeliveryTag != 3 {
+			t.Error("should deliver next message, got", d.DeliveryTag)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("should deliver once a slot is freed")
+	}
+
+	c.detach()
+	<-done
+}
+
+func TestConsumer_RateLimit(t *testing.T) {
+	var (
+		done       = make(chan bool)
+		deliveries = make(chan amqp.Delivery, 2)
+	)
+
+	c := newTestConsumer(RateLimit(0.001, 1))
+	c.attach()
+
+	ch1 := &mqChannelTest{
+		_Qos: func(int, int, bool) error {
+			return nil
+		},
+		_Consume: func(string, string, bool, bool, bool, bool, amqp.Table) (<-chan amqp.Delivery, error) {
+			return deliveries, nil
+		},
+		_Close: func() error {
+			return nil
+		},
+	}
+
+	go func() {
+		c.serve(&mqDeleterTest{}, ch1)
+		done <- true
+	}()
+
+	deliveries <- amqp.Delivery{DeliveryTag: 1}
+	deliveries <- amqp.Delivery{DeliveryTag: 2}
+
+	<-c.Deliveries()
+
+	select {
+	case <-c.Deliveries():
+		t.Fatal("should wait for rate limit")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	c.detach()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("should interrupt rate limit wait on detach")
+	}
+}
+
+func TestRateLimit_nonPositive(t *testing.T) {
+	for _, rate := range []float64{0, -1} {
+		c := newTestConsumer(RateLimit(rate, 1))
+
+		if c.limiter != nil {
+			t.Error("should ignore rate", rate)
+		}
+	}
+}
+
+func TestMaxConcurrency_nonPositive(t *testing.T) {
+	for _, n := range []int{0, -1} {
+		c := newTestConsumer(MaxConcurrency(n))
+
+		if c.slots != nil {
+			t.Error("should ignore concurrency cap", n)
+		}
+
+		if c.qos != 0 {
+			t.Error("should not set prefetch, got", c.qos)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+package cony
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+var (
+	// ErrNoCertificates is returned when CA bundle file has no PEM
+	// certificates
+	ErrNoCertificates = errors.New("No certificates found in CA file")
+
+	// ErrTLSRequired is reported when TLS options or SASL EXTERNAL are used
+	// with amqp:// URL, credentials must not be sent in plain text
+	ErrTLSRequired = errors.New("TLS options require amqps URL")
+)
+
+// ExternalAuth is SASL EXTERNAL mechanism: the server authenticates the
+// client by its TLS certificate (rabbitmq_auth_mechanism_ssl plugin).
+type ExternalAuth struct{}
+
+// Mechanism implements amqp.Authentication
+func (ExternalAuth) Mechanism() string {
+	return "EXTERNAL"
+}
+
+// Response implements amqp.Authentication
+func (ExternalAuth) Response() string {
+	return ""
+}
+
+// tlsFiles keeps TLS material loaded from files, reloading it once files
+// change on disk
+type tlsFiles struct {
+	caFile   string
+	certFile string
+	keyFile  string
+	external bool // SASL EXTERNAL
+
+	caMod   time.Time
+	roots   *x509.CertPool
+	certMod time.Time
+	cert    *tls.Certificate
+	l       sync.Mutex
+}
+
+// rootCAs returns CA pool, reloaded if CA file was modified
+func (f *tlsFiles) rootCAs() (*x509.CertPool, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	mod, err := modTime(f.caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	if f.roots != nil && mod.Equal(f.caMod) {
+		return f.roots, nil
+	}
+
+	pem, err := os.ReadFile(f.caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(pem) {
+		return nil, ErrNoCertificates
+	}
+
+	f.roots, f.caMod = roots, mod
+	return roots, nil
+}
+
+// clientCert returns client certificate, reloaded if certificate or key file
+// was modified
+func (f *tlsFiles) clientCert() (*tls.Certificate, error) {
+	f.l.Lock()
+	defer f.l.Unlock()
+
+	certMod, err := modTime(f.certFile)
+	if err != nil {
+		return nil, err
+	}
+
+	keyMod, err := modTime(f.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	mod := certMod
+	if keyMod.After(mod) {
+		mod = keyMod
+	}
+
+	if f.cert != nil && mod.Equal(f.certMod) {
+		return f.cert, nil
+	}
+
+	cert, err := tls.LoadX509KeyPair(f.certFile, f.keyFile)
+	if err != nil {
+		return nil, err
+	}
+
+	f.cert, f.certMod = &cert, mod
+	return f.cert, nil
+}
+
+// apply sets up TLS config from the files
+func (f *tlsFiles) apply(cfg *tls.Config) error {
+	if f.caFile != "" {
+		roots, err := f.rootCAs()
+		if err != nil {
+			return err
+		}
+		cfg.RootCAs = roots
+	}
+
+	if f.certFile != "" {
+		// checked on every handshake, so rotated certificate is picked up
+		// without waiting for a reconnect
+		cfg.GetClientCertificate = func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			return f.clientCert()
+		}
+	}
+
+	return nil
+}
+
+func modTime(path string) (time.Time, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return fi.ModTime(), nil
+}
+
+// dialConfig returns amqp.Config for the next dial to addr. TLS config is
+// copied for every dial, with ServerName of the node being dialed, as
+// amqp.DialConfig keeps the first ServerName it sees in a shared config.
+func (c *Client) dialConfig(addr string) (amqp.Config, error) {
+	config := c.config
+
+	// set default Heartbeat to 10 seconds like in original amqp.Dial
+	if config.Heartbeat == 0 {
+		config.Heartbeat = 10 * time.Second
+	}
+
+	if c.tls != nil && c.tls.external {
+		config.SASL = []amqp.Authentication{ExternalAuth{}}
+	}
+
+	if config.TLSClientConfig == nil && c.tls == nil {
+		return config, nil
+	}
+
+	uri, err := amqp.ParseURI(addr)
+	if err != nil {
+		return config, err
+	}
+
+	if uri.Scheme != "amqps" {
+		if c.tls != nil {
+			return config, ErrTLSRequired
+		}
+		return config, nil
+	}
+
+	tlsConfig := &tls.Config{}
+	if config.TLSClientConfig != nil {
+		tlsConfig = config.TLSClientConfig.Clone()
+	}
+
+	if tlsConfig.ServerName == "" {
+		tlsConfig.ServerName = uri.Host
+	}
+
+	if c.tls != nil {
+		if err := c.tls.apply(tlsConfig); err != nil {
+			return config, err
+		}
+	}
+
+	config.TLSClientConfig = tlsConfig
+	return config, nil
+}
+
+func (c *Client) tlsFiles() *tlsFiles {
+	if c.tls == nil {
+		c.tls = &tlsFiles{}
+	}
+	return c.tls
+}
+
+// TLSCAFile is a functional option, used to verify the server with CA bundle
+// (PEM) loaded from file. The file is re-read on reconnect if it changed.
+func TLSCAFile(path string) ClientOpt {
+	return func(c *Client) {
+		c.tlsFiles().caFile = path
+	}
+}
+
+// TLSClientCertFile is a functional option, used to present client
+// certificate loaded from PEM files. Files are re-read on every TLS handshake
+// if they changed, so rotated certificates are picked up.
+func TLSClientCertFile(certFile, keyFile string) ClientOpt {
+	return func(c *Client) {
+		f := c.tlsFiles()
+		f.certFile = certFile
+		f.keyFile = keyFile
+	}
+}
+
+// SASLExternal is a functional option, used to authenticate with client TLS
+// certificate (SASL EXTERNAL) instead of username and password. Like other
+// TLS options it requires amqps URL, ErrTLSRequired is reported otherwise.
+func SASLExternal() ClientOpt {
+	return func(c *Client) {
+		c.tlsFiles().external = true
+	}
+}
@@ -0,0 +1,287 @@
+package cony
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCert(t *testing.T, serial int64, name string, parent *testCert) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		DNSNames:     []string{name},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+
+	signer, signerKey := tmpl, key
+	if parent == nil {
+		tmpl.IsCA = true
+		tmpl.BasicConstraintsValid = true
+		tmpl.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, _ := x509.ParseCertificate(der)
+	return &testCert{cert: cert, key: key}
+}
+
+func (c *testCert) write(t *testing.T, certFile, keyFile string, mod time.Time) {
+	writePEM(t, certFile, "CERTIFICATE", c.cert.Raw, mod)
+
+	if keyFile != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		writePEM(t, keyFile, "EC PRIVATE KEY", der, mod)
+	}
+}
+
+func (c *testCert) tls() tls.Certificate {
+	return tls.Certificate{Certificate: [][]byte{c.cert.Raw}, PrivateKey: c.key}
+}
+
+func writePEM(t *testing.T, path, typ string, der []byte, mod time.Time) {
+	b := pem.EncodeToMemory(&pem.Block{Type: typ, Bytes: der})
+	if err := os.WriteFile(path, b, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// file system time resolution may be too coarse to see the rotation
+	if err := os.Chtimes(path, mod, mod); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// startTLSListener accepts TLS connections requiring client certificates
+// signed by ca, reports serial numbers of client certificates
+func startTLSListener(t *testing.T, ca, server *testCert) (net.Listener, chan int64) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	l, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{server.tls()},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serials := make(chan int64, 10)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			tlsConn := conn.(*tls.Conn)
+			if tlsConn.Handshake() == nil {
+				serials <- tlsConn.ConnectionState().PeerCertificates[0].SerialNumber.Int64()
+			}
+			conn.Close()
+		}
+	}()
+
+	return l, serials
+}
+
+func TestClient_dialConfig_TLS(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	ca := newTestCert(t, 1, "ca", nil)
+	server := newTestCert(t, 2, "localhost", ca)
+	client1 := newTestCert(t, 3, "client", ca)
+	client2 := newTestCert(t, 4, "client", ca)
+
+	now := time.Now()
+	ca.write(t, caFile, "", now)
+	client1.write(t, certFile, keyFile, now)
+
+	l, serials := startTLSListener(t, ca, server)
+	defer l.Close()
+	_, port, _ := net.SplitHostPort(l.Addr().String())
+
+	c := NewClient(TLSCAFile(caFile), TLSClientCertFile(certFile, keyFile), SASLExternal())
+
+	handshake := func(addr string) error {
+		config, err := c.dialConfig(addr)
+		if err != nil {
+			return err
+		}
+
+		conn, err := tls.Dial("tcp", "127.0.0.1:"+port, config.TLSClientConfig)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		return conn.Handshake()
+	}
+
+	if err := handshake("amqps://localhost:" + port + "/"); err != nil {
+		t.Fatal("should verify server and present client certificate, got", err)
+	}
+
+	if serial := <-serials; serial != 3 {
+		t.Error("should present client certificate, got serial", serial)
+	}
+
+	// rotate client certificate on disk
+	client2.write(t, certFile, keyFile, now.Add(time.Minute))
+
+	if err := handshake("amqps://localhost:" + port + "/"); err != nil {
+		t.Fatal(err)
+	}
+
+	if serial := <-serials; serial != 4 {
+		t.Error("should reload rotated client certificate, got serial", serial)
+	}
+
+	config, _ := c.dialConfig("amqps://localhost:" + port + "/")
+	if len(config.SASL) != 1 || config.SASL[0].Mechanism() != "EXTERNAL" {
+		t.Error("should use SASL EXTERNAL")
+	}
+}
+
+func TestClient_dialConfig_clusterNodes(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	ca := newTestCert(t, 1, "ca", nil)
+	client := newTestCert(t, 2, "client", ca)
+	ca.write(t, caFile, "", time.Now())
+	client.write(t, certFile, keyFile, time.Now())
+
+	var addrs []string
+	for i, node := range []string{"node1", "node2"} {
+		l, _ := startTLSListener(t, ca, newTestCert(t, int64(10+i), node, ca))
+		defer l.Close()
+		_, port, _ := net.SplitHostPort(l.Addr().String())
+		addrs = append(addrs, "amqps://"+node+":"+port+"/")
+	}
+	// node3 is served with the certificate of node1
+	addrs = append(addrs, "amqps://node3"+addrs[0][len("amqps://node1"):])
+
+	c := NewClient(URLs(addrs...), TLSCAFile(caFile), TLSClientCertFile(certFile, keyFile))
+
+	for i := 0; i < 2*len(addrs); i++ {
+		addr := c.nodeAddr()
+		if addr != addrs[i%len(addrs)] {
+			t.Fatal("should dial nodes in turn, got", addr)
+		}
+
+		config, err := c.dialConfig(addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		uri, _ := amqp.ParseURI(addr)
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", uri.Port), config.TLSClientConfig)
+		if err == nil {
+			err = conn.Handshake()
+			conn.Close()
+		}
+
+		if uri.Host == "node3" {
+			if err == nil {
+				t.Error("should verify server name of the node being dialed")
+			}
+		} else if err != nil {
+			t.Errorf("should verify %s, got %v", uri.Host, err)
+		}
+	}
+}
+
+func TestClient_dialConfig_CARotation(t *testing.T) {
+	dir := t.TempDir()
+	caFile := filepath.Join(dir, "ca.pem")
+
+	ca1 := newTestCert(t, 1, "ca1", nil)
+	ca2 := newTestCert(t, 2, "ca2", nil)
+
+	now := time.Now()
+	ca1.write(t, caFile, "", now)
+
+	c := NewClient(TLSCAFile(caFile))
+
+	config, err := c.dialConfig("amqps://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots1 := config.TLSClientConfig.RootCAs
+
+	config, _ = c.dialConfig("amqps://localhost/")
+	if config.TLSClientConfig.RootCAs != roots1 {
+		t.Error("should not reload unchanged CA file")
+	}
+
+	ca2.write(t, caFile, "", now.Add(time.Minute))
+
+	config, _ = c.dialConfig("amqps://localhost/")
+	if config.TLSClientConfig.RootCAs == roots1 {
+		t.Error("should reload rotated CA file")
+	}
+
+	os.WriteFile(caFile, []byte("garbage"), 0600)
+	os.Chtimes(caFile, now.Add(2*time.Minute), now.Add(2*time.Minute))
+
+	if _, err := c.dialConfig("amqps://localhost/"); err != ErrNoCertificates {
+		t.Error("should report CA file without certificates, got", err)
+	}
+}
+
+func TestClient_dialConfig_plain(t *testing.T) {
+	c := NewClient(Config(amqp.Config{TLSClientConfig: &tls.Config{}}))
+
+	config, err := c.dialConfig("amqp://localhost/")
+	if err != nil {
+		t.Error(err)
+	}
+
+	if config.Heartbeat != 10*time.Second {
+		t.Error("should set default heartbeat")
+	}
+
+	for _, opt := range []ClientOpt{TLSCAFile("/nonexistent"), SASLExternal()} {
+		c := NewClient(opt)
+		if _, err := c.dialConfig("amqp://localhost/"); err != ErrTLSRequired {
+			t.Error("should refuse TLS options with amqp scheme, got", err)
+		}
+	}
+}